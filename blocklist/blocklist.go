@@ -0,0 +1,445 @@
+// Package blocklist answers queries for listed domains according to
+// per-list response policies.
+package blocklist
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/miekg/dns"
+)
+
+const (
+	BlockNXDomain = iota
+	BlockNoData
+	BlockRefused
+	BlockSinkhole
+	BlockLocalData // RPZ local data
+	BlockPassthru  // RPZ rpz-passthru. or adblock @@ exception
+	BlockDrop      // RPZ rpz-drop.
+)
+
+var blocklistLog = logging.New("Blocklist")
+
+// TTL used for synthesized sinkhole records
+const blockTTL = 60
+
+type BlockPolicy struct {
+	Action   int
+	Sinkhole netip.Addr
+}
+
+type blockRule struct {
+	Action int
+	RRs    []dns.RR
+}
+
+type Blocklist struct {
+	Path      string
+	Format    string
+	Policy    BlockPolicy
+	Mutex     sync.RWMutex
+	Exact     map[string]*blockRule
+	Wildcard  map[string]*blockRule
+	ModTime   time.Time
+	RuleCount int
+}
+
+// New parses a list given as
+// "file[,format=domains|hosts|adblock|rpz][,policy=nxdomain|nodata|refused|sinkhole:IP]".
+// The list is empty until Load is called.
+func New(s string) (*Blocklist, error) {
+	parts := strings.Split(s, ",")
+	l := &Blocklist{
+		Path:   parts[0],
+		Format: "domains",
+		Policy: BlockPolicy{Action: BlockNXDomain},
+	}
+	if l.Path == "" {
+		return nil, errors.New("missing file path")
+	}
+	for _, part := range parts[1:] {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "format":
+			switch value {
+			case "domains", "hosts", "adblock", "rpz":
+				l.Format = value
+			default:
+				return nil, fmt.Errorf("unknown format %q", value)
+			}
+		case "policy":
+			policy, err := parseBlockPolicy(value)
+			if err != nil {
+				return nil, err
+			}
+			l.Policy = policy
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return l, nil
+}
+
+func parseBlockPolicy(s string) (BlockPolicy, error) {
+	switch s {
+	case "nxdomain":
+		return BlockPolicy{Action: BlockNXDomain}, nil
+	case "nodata":
+		return BlockPolicy{Action: BlockNoData}, nil
+	case "refused":
+		return BlockPolicy{Action: BlockRefused}, nil
+	}
+	if strings.HasPrefix(s, "sinkhole:") {
+		ip := strings.TrimPrefix(s, "sinkhole:")
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return BlockPolicy{}, fmt.Errorf("invalid sinkhole address %q", ip)
+		}
+		return BlockPolicy{Action: BlockSinkhole, Sinkhole: addr.Unmap()}, nil
+	}
+	return BlockPolicy{}, fmt.Errorf("unknown policy %q", s)
+}
+
+// Load (re)reads the list from disk. The file is skipped if it has not
+// changed since the last successful load.
+func (l *Blocklist) Load() error {
+	f, err := os.Open(l.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(l.ModTime) {
+		return nil
+	}
+
+	exact := make(map[string]*blockRule)
+	wildcard := make(map[string]*blockRule)
+	var count int
+	add := func(name string, isWildcard bool, action int, rr dns.RR) {
+		m := exact
+		if isWildcard {
+			m = wildcard
+		}
+		if rule, found := m[name]; found {
+			if rr != nil && rule.Action == BlockLocalData {
+				rule.RRs = append(rule.RRs, rr)
+			}
+			return
+		}
+		rule := &blockRule{Action: action}
+		if rr != nil {
+			rule.RRs = []dns.RR{rr}
+		}
+		m[name] = rule
+		count++
+	}
+
+	if l.Format == "rpz" {
+		err = parseRPZ(f, l.Path, add)
+	} else {
+		err = l.parseLines(f, add)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.Mutex.Lock()
+	l.Exact = exact
+	l.Wildcard = wildcard
+	l.ModTime = fi.ModTime()
+	l.RuleCount = count
+	l.Mutex.Unlock()
+
+	blocklistLog.Info("Loaded blocklist", "path", l.Path, "rules", count)
+	return nil
+}
+
+func (l *Blocklist) parseLines(r io.Reader, add func(string, bool, int, dns.RR)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '#'); i != -1 && l.Format != "adblock" {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		switch l.Format {
+		case "domains":
+			name, isWildcard := cutWildcard(line)
+			if _, ok := dns.IsDomainName(name); ok {
+				add(dns.CanonicalName(name), isWildcard, l.Policy.Action, nil)
+			}
+
+		case "hosts":
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			if _, err := netip.ParseAddr(fields[0]); err != nil {
+				continue
+			}
+			for _, name := range fields[1:] {
+				switch name {
+				case "localhost", "localhost.localdomain", "local", "broadcasthost",
+					"ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix",
+					"ip6-allnodes", "ip6-allrouters", "ip6-allhosts", "0.0.0.0":
+					continue
+				}
+				if _, ok := dns.IsDomainName(name); ok {
+					add(dns.CanonicalName(name), false, l.Policy.Action, nil)
+				}
+			}
+
+		case "adblock":
+			// only domain anchored rules ("||example.com^") map to DNS
+			if line[0] == '!' || line[0] == '[' {
+				continue
+			}
+			action := l.Policy.Action
+			if strings.HasPrefix(line, "@@") {
+				line = line[2:]
+				action = BlockPassthru
+			}
+			if !strings.HasPrefix(line, "||") {
+				continue
+			}
+			rule := line[2:]
+			if i := strings.IndexByte(rule, '$'); i != -1 {
+				rule = rule[:i]
+			}
+			if !strings.HasSuffix(rule, "^") {
+				continue
+			}
+			name := strings.TrimSuffix(rule, "^")
+			if _, ok := dns.IsDomainName(name); !ok || strings.ContainsAny(name, "/*") {
+				continue
+			}
+			name = dns.CanonicalName(name)
+			add(name, false, action, nil)
+			add(name, true, action, nil)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseRPZ reads the QNAME triggers of a response policy zone
+func parseRPZ(r io.Reader, file string, add func(string, bool, int, dns.RR)) error {
+	var apex string
+	zp := dns.NewZoneParser(r, "", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeSOA {
+			if apex == "" {
+				apex = dns.CanonicalName(hdr.Name)
+			}
+			continue
+		}
+		if hdr.Rrtype == dns.TypeNS || apex == "" {
+			continue
+		}
+
+		owner := dns.CanonicalName(hdr.Name)
+		if !strings.HasSuffix(owner, "."+apex) {
+			continue
+		}
+		name := strings.TrimSuffix(owner, "."+apex)
+		// IP, NSDNAME, NSIP and client IP triggers are not supported
+		labels := dns.SplitDomainName(name)
+		if strings.HasPrefix(labels[len(labels)-1], "rpz-") {
+			continue
+		}
+		name, isWildcard := cutWildcard(name + ".")
+
+		action := BlockLocalData
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch target := dns.CanonicalName(cname.Target); target {
+			case ".":
+				action = BlockNXDomain
+			case "*.":
+				action = BlockNoData
+			case "rpz-passthru.":
+				action = BlockPassthru
+			case "rpz-drop.":
+				action = BlockDrop
+			default:
+				if strings.HasPrefix(target, "rpz-") {
+					continue
+				}
+			}
+		}
+		if action == BlockLocalData {
+			add(name, isWildcard, action, dns.Copy(rr))
+		} else {
+			add(name, isWildcard, action, nil)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	if apex == "" {
+		return errors.New("missing SOA record")
+	}
+	return nil
+}
+
+// cutWildcard strips a leading "*." label
+func cutWildcard(name string) (string, bool) {
+	if strings.HasPrefix(name, "*.") {
+		return name[2:], true
+	}
+	return name, false
+}
+
+func (l *Blocklist) match(name string) *blockRule {
+	l.Mutex.RLock()
+	defer l.Mutex.RUnlock()
+	if rule, found := l.Exact[name]; found {
+		return rule
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rule, found := l.Wildcard[name[off:]]; found {
+			return rule
+		}
+	}
+	return nil
+}
+
+type Config struct {
+	// Interval between checks for changed list files, 0 disables reloading
+	ReloadInterval time.Duration
+	// EDNS UDP buffer size advertised in generated responses
+	UDPBufferSize uint16
+}
+
+// Filter answers queries matching a blocklist according to the list's
+// policy and passes everything else on. The first matching list wins.
+type Filter struct {
+	Blocklists []*Blocklist
+	Config     Config
+	Done       chan bool
+}
+
+func NewFilter(blocklists []*Blocklist, cfg Config) *Filter {
+	if cfg.UDPBufferSize == 0 {
+		cfg.UDPBufferSize = 1232
+	}
+	f := &Filter{
+		Blocklists: blocklists,
+		Config:     cfg,
+		Done:       make(chan bool),
+	}
+	if cfg.ReloadInterval > 0 {
+		go f.reload(cfg.ReloadInterval)
+	}
+	return f
+}
+
+// Stage is a chain.Stage applying the blocklists
+func (f *Filter) Stage(next chain.Handler) chain.Handler {
+	return chain.HandlerFunc(func(ctx context.Context, r *chain.Request) (*dns.Msg, error) {
+		req := r.Msg
+		name := dns.CanonicalName(req.Question[0].Name)
+		for _, l := range f.Blocklists {
+			rule := l.match(name)
+			if rule == nil {
+				continue
+			}
+			blocklistLog.Debug("Query matched blocklist", "id", req.Id, "name", name, "path", l.Path)
+			switch rule.Action {
+			case BlockPassthru:
+				return next.ServeDNS(ctx, r)
+			case BlockDrop:
+				return nil, forwarder.ErrDropped
+			case BlockLocalData:
+				return localDataResponse(req, rule.RRs, f.Config.UDPBufferSize), nil
+			}
+			policy := l.Policy
+			policy.Action = rule.Action
+			return blockedResponse(req, policy, f.Config.UDPBufferSize), nil
+		}
+		return next.ServeDNS(ctx, r)
+	})
+}
+
+// Close stops reloading the lists
+func (f *Filter) Close() {
+	close(f.Done)
+}
+
+func (f *Filter) reload(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, l := range f.Blocklists {
+				if err := l.Load(); err != nil {
+					blocklistLog.Warn("Reload error", "path", l.Path, "error", err)
+				}
+			}
+
+		case <-f.Done:
+			return
+		}
+	}
+}
+
+func blockedResponse(req *dns.Msg, policy BlockPolicy, udpBufferSize uint16) *dns.Msg {
+	rcode := dns.RcodeSuccess
+	var ede *dns.EDNS0_EDE
+	switch policy.Action {
+	case BlockNXDomain:
+		rcode = dns.RcodeNameError
+	case BlockRefused:
+		rcode = dns.RcodeRefused
+		ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: "Blocked"}
+	}
+	resp := forwarder.RcodeResponse(req, rcode, ede, udpBufferSize)
+
+	if policy.Action == BlockSinkhole {
+		q := req.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockTTL}
+		if q.Qtype == dns.TypeA && policy.Sinkhole.Is4() {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: policy.Sinkhole.AsSlice()})
+		} else if q.Qtype == dns.TypeAAAA && policy.Sinkhole.Is6() {
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: policy.Sinkhole.AsSlice()})
+		}
+	}
+	return resp
+}
+
+func localDataResponse(req *dns.Msg, rrs []dns.RR, udpBufferSize uint16) *dns.Msg {
+	resp := new(dns.Msg).SetReply(req)
+	resp.RecursionAvailable = true
+	q := req.Question[0]
+	for _, rr := range rrs {
+		if rrtype := rr.Header().Rrtype; rrtype == q.Qtype || rrtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if reqOpt := req.IsEdns0(); reqOpt != nil {
+		resp.SetEdns0(udpBufferSize, reqOpt.Do())
+	}
+	return resp
+}
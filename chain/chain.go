@@ -0,0 +1,114 @@
+// Package chain runs queries through an ordered list of stages, in the
+// manner of CoreDNS plugins. Each stage either answers a query itself,
+// stopping the chain, or passes it on to the next stage. All listeners of
+// the dow-proxy command share one chain.
+package chain
+
+import (
+	"context"
+
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/miekg/dns"
+)
+
+type Request struct {
+	Msg *dns.Msg
+	// Client address as "IP:port", or just "IP" when taken from X-Real-IP
+	Client string
+	// "udp", "tcp" or "ws"
+	Transport string
+	// Stream writes a response in wire format to the client as it is, for
+	// responses that must not be changed: zone transfers and messages signed
+	// with TSIG. Nil if the transport cannot carry them.
+	Stream func(resp []byte) error
+	// Raw is Msg in wire format as the client sent it, kept for messages
+	// signed with TSIG so that they are forwarded unchanged. Nil if unknown.
+	Raw []byte
+
+	cacheHit *bool
+	upstream *string
+}
+
+// WithMsg returns a copy of r for a changed message, without Raw unless m
+// is r.Msg. Stages changing the query should pass the copy on instead of
+// modifying r.Msg.
+func (r *Request) WithMsg(m *dns.Msg) *Request {
+	if r.cacheHit == nil {
+		r.cacheHit = new(bool)
+	}
+	if r.upstream == nil {
+		r.upstream = new(string)
+	}
+	c := *r
+	if m != r.Msg {
+		c.Raw = nil
+	}
+	c.Msg = m
+	return &c
+}
+
+// SetCacheHit marks r, and the requests it was copied from, as answered
+// from a cache
+func (r *Request) SetCacheHit() {
+	if r.cacheHit == nil {
+		r.cacheHit = new(bool)
+	}
+	*r.cacheHit = true
+}
+
+func (r *Request) CacheHit() bool {
+	return r.cacheHit != nil && *r.cacheHit
+}
+
+// SetUpstream records the address of the upstream the query was sent to in
+// r, and the requests it was copied from
+func (r *Request) SetUpstream(addr string) {
+	if r.upstream == nil {
+		r.upstream = new(string)
+	}
+	*r.upstream = addr
+}
+
+// Upstream returns the address of the upstream the query was sent to, or ""
+// if it was answered locally
+func (r *Request) Upstream() string {
+	if r.upstream == nil {
+		return ""
+	}
+	return *r.upstream
+}
+
+// Handler answers requests. Errors are those of forwarder.Forwarder; a nil
+// response with a nil error means the query goes unanswered.
+type Handler interface {
+	ServeDNS(ctx context.Context, r *Request) (*dns.Msg, error)
+}
+
+type HandlerFunc func(ctx context.Context, r *Request) (*dns.Msg, error)
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, r *Request) (*dns.Msg, error) {
+	return f(ctx, r)
+}
+
+// Stage wraps the rest of the chain
+type Stage func(next Handler) Handler
+
+// New returns a handler passing requests through stages in order, ending
+// with last
+func New(last Handler, stages ...Stage) Handler {
+	h := last
+	for i := len(stages) - 1; i >= 0; i-- {
+		h = stages[i](h)
+	}
+	return h
+}
+
+// Resolve runs r through h and returns the response for the client, or nil
+// if there should be none
+func Resolve(ctx context.Context, h Handler, r *Request, udpBufferSize uint16) *dns.Msg {
+	resp, err := h.ServeDNS(ctx, r)
+	if err != nil {
+		return forwarder.ErrorResponse(r.Msg, err, udpBufferSize)
+	}
+	return resp
+}
@@ -0,0 +1,154 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/miekg/dns"
+)
+
+const (
+	ECSPass = iota
+	ECSStrip
+	ECSAdd
+)
+
+// ECSPolicy decides what happens to EDNS Client Subnet options in queries
+type ECSPolicy struct {
+	// ECSPass forwards queries unchanged, ECSStrip removes the option and
+	// ECSAdd replaces it with the client address truncated to the prefix
+	// lengths below. Private and loopback client addresses are never added,
+	// and clients opting out with a source prefix of 0 are respected.
+	Mode       int
+	IPv4Prefix uint8
+	IPv6Prefix uint8
+	// EDNS UDP buffer size used when an OPT record has to be added
+	UDPBufferSize uint16
+}
+
+// ParseECSMode parses "pass", "strip" or "add"
+func ParseECSMode(s string) (int, error) {
+	switch s {
+	case "pass":
+		return ECSPass, nil
+	case "strip":
+		return ECSStrip, nil
+	case "add":
+		return ECSAdd, nil
+	}
+	return 0, fmt.Errorf("unknown policy %q", s)
+}
+
+// ClientSubnet applies the policy to queries, and makes sure responses only
+// carry a subnet option if the client sent one
+func ClientSubnet(policy ECSPolicy) Stage {
+	return func(next Handler) Handler {
+		if policy.Mode == ECSPass {
+			return next
+		}
+		return HandlerFunc(func(ctx context.Context, r *Request) (*dns.Msg, error) {
+			if r.Msg.IsTsig() != nil {
+				// changing signed queries would invalidate the signature
+				return next.ServeDNS(ctx, r)
+			}
+			reqOpt := r.Msg.IsEdns0()
+			clientSubnet := subnetOption(reqOpt)
+			if clientSubnet != nil && clientSubnet.SourceNetmask == 0 && policy.Mode == ECSAdd {
+				// the client asked for its address not to be used
+				return next.ServeDNS(ctx, r)
+			}
+
+			var subnet *dns.EDNS0_SUBNET
+			if policy.Mode == ECSAdd {
+				subnet = policy.subnet(r.Client)
+			}
+			if clientSubnet == nil && subnet == nil {
+				return next.ServeDNS(ctx, r)
+			}
+
+			req := r.Msg.Copy()
+			opt := req.IsEdns0()
+			if opt == nil {
+				req.SetEdns0(policy.UDPBufferSize, false)
+				opt = req.IsEdns0()
+			}
+			removeSubnet(opt)
+			if subnet != nil {
+				opt.Option = append(opt.Option, subnet)
+			}
+
+			resp, err := next.ServeDNS(ctx, r.WithMsg(req))
+			if resp == nil {
+				return resp, err
+			}
+			if respOpt := resp.IsEdns0(); respOpt != nil {
+				if reqOpt == nil {
+					forwarder.RemoveOPT(resp)
+				} else if removeSubnet(respOpt) && clientSubnet != nil {
+					// echo what the client sent, saying nothing about scope
+					respOpt.Option = append(respOpt.Option, clientSubnet)
+				}
+			}
+			return resp, err
+		})
+	}
+}
+
+// subnet returns the option to add for a client address, or nil
+func (p ECSPolicy) subnet(client string) *dns.EDNS0_SUBNET {
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(client)
+		if err != nil {
+			return nil
+		}
+		addr = addrPort.Addr()
+	}
+	addr = addr.Unmap()
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return nil
+	}
+
+	family, bits := uint16(1), int(p.IPv4Prefix)
+	if addr.Is6() {
+		family, bits = 2, int(p.IPv6Prefix)
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return nil
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(bits),
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	}
+}
+
+func subnetOption(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// removeSubnet removes subnet options and reports whether there were any
+func removeSubnet(opt *dns.OPT) bool {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	removed := len(options) != len(opt.Option)
+	opt.Option = options
+	return removed
+}
@@ -0,0 +1,122 @@
+package chain
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/miekg/dns"
+)
+
+const (
+	ANYPass = iota
+	ANYRefuse
+	ANYMinimize
+)
+
+// TTL of the HINFO record answering minimized ANY queries, as suggested by
+// RFC 8482
+const anyTTL = 3789
+
+// QtypePolicy decides which query types are answered
+type QtypePolicy struct {
+	// ANYPass forwards ANY queries, ANYRefuse refuses them and ANYMinimize
+	// answers them with a single HINFO record as described in RFC 8482
+	ANY int
+	// Refuse AXFR and IXFR queries over UDP
+	BlockUDPTransfers bool
+	// Query types to refuse
+	Deny map[uint16]bool
+	// Responses larger than this many bytes are refused, 0 for no limit
+	MaxResponseSize int
+	// EDNS UDP buffer size advertised in generated responses
+	UDPBufferSize uint16
+}
+
+// ParseANYMode parses "pass", "refuse" or "minimize"
+func ParseANYMode(s string) (int, error) {
+	switch s {
+	case "pass":
+		return ANYPass, nil
+	case "refuse":
+		return ANYRefuse, nil
+	case "minimize":
+		return ANYMinimize, nil
+	}
+	return 0, fmt.Errorf("unknown policy %q", s)
+}
+
+// ParseTypes parses a comma separated list of query types such as
+// "NULL,HINFO,TYPE65"
+func ParseTypes(s string) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		qtype, found := dns.StringToType[name]
+		if !found {
+			var n uint16
+			if _, err := fmt.Sscanf(name, "TYPE%d", &n); err != nil {
+				return nil, fmt.Errorf("unknown type %q", name)
+			}
+			qtype = n
+		}
+		types[qtype] = true
+	}
+	return types, nil
+}
+
+// QueryTypes applies the policy to queries and their responses
+func QueryTypes(policy QtypePolicy) Stage {
+	return func(next Handler) Handler {
+		if policy.ANY == ANYPass && !policy.BlockUDPTransfers && len(policy.Deny) == 0 && policy.MaxResponseSize == 0 {
+			return next
+		}
+		return HandlerFunc(func(ctx context.Context, r *Request) (*dns.Msg, error) {
+			req := r.Msg
+			qtype := req.Question[0].Qtype
+			typeName := dns.Type(qtype).String()
+			switch {
+			case policy.Deny[qtype]:
+				return policy.refuse(req, dns.ExtendedErrorCodeProhibited, typeName+" queries are not allowed"), nil
+			case policy.BlockUDPTransfers && r.Transport == "udp" && (qtype == dns.TypeAXFR || qtype == dns.TypeIXFR):
+				return policy.refuse(req, dns.ExtendedErrorCodeNotSupported, typeName+" queries are not allowed over UDP"), nil
+			case qtype == dns.TypeANY && policy.ANY == ANYRefuse:
+				return policy.refuse(req, dns.ExtendedErrorCodeNotSupported, "ANY queries are not supported"), nil
+			case qtype == dns.TypeANY && policy.ANY == ANYMinimize:
+				return policy.minimalANY(req), nil
+			}
+
+			resp, err := next.ServeDNS(ctx, r)
+			if resp == nil || policy.MaxResponseSize == 0 {
+				return resp, err
+			}
+			if size := resp.Len(); size > policy.MaxResponseSize {
+				return policy.refuse(req, dns.ExtendedErrorCodeProhibited, fmt.Sprintf("Response of %d bytes exceeds the limit of %d bytes", size, policy.MaxResponseSize)), nil
+			}
+			return resp, err
+		})
+	}
+}
+
+func (p QtypePolicy) refuse(req *dns.Msg, code uint16, text string) *dns.Msg {
+	ede := &dns.EDNS0_EDE{InfoCode: code, ExtraText: text}
+	return forwarder.RcodeResponse(req, dns.RcodeRefused, ede, p.UDPBufferSize)
+}
+
+func (p QtypePolicy) minimalANY(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	ede := &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeOther,
+		ExtraText: "ANY queries are answered minimally, see RFC 8482",
+	}
+	resp := forwarder.RcodeResponse(req, dns.RcodeSuccess, ede, p.UDPBufferSize)
+	resp.Answer = []dns.RR{&dns.HINFO{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: q.Qclass, Ttl: anyTTL},
+		Cpu: "RFC8482",
+	}}
+	return resp
+}
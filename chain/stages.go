@@ -0,0 +1,169 @@
+package chain
+
+import (
+	"context"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/dnschecktool/dow-proxy/querylog"
+	"github.com/miekg/dns"
+)
+
+var chainLog = logging.New("Chain")
+
+// Forward is the usual last handler, sending queries to the upstream and
+// turning its errors into responses. Zone transfers and signed queries over
+// TCP and WebSocket are relayed through r.Stream if the upstream is a
+// forwarder.Relayer; the response is then nil, having been written already.
+// Signed queries are sent upstream as r.Raw where the upstream allows it.
+func Forward(upstream forwarder.Forwarder, udpBufferSize uint16) Handler {
+	return HandlerFunc(func(ctx context.Context, r *Request) (*dns.Msg, error) {
+		upstream := upstream
+		if f, ok := upstream.(*forwarder.FailoverForwarder); ok {
+			upstream = f.Current()
+		}
+		r.SetUpstream(upstream.Address())
+
+		// UDP responses must go through Truncate and RRL, signed ones are
+		// forwarded like any other
+		relayer, ok := upstream.(forwarder.Relayer)
+		relay := r.Stream != nil && r.Transport != "udp" && (forwarder.IsTransfer(r.Msg) || r.Msg.IsTsig() != nil)
+		if ok && relay {
+			err := relayer.RelayContext(ctx, r.Msg, r.Raw, r.Stream)
+			if err == nil {
+				return nil, nil
+			}
+			chainLog.Debug("Relay error", "id", r.Msg.Id, "client", r.Client, "error", err)
+			if resp := forwarder.ErrorResponse(r.Msg, err, udpBufferSize); resp != nil {
+				return resp, nil
+			}
+			return nil, err
+		}
+
+		var resp *dns.Msg
+		var err error
+		if raw, ok := upstream.(forwarder.RawForwarder); ok && r.Raw != nil {
+			resp, err = raw.ForwardRawContext(ctx, r.Msg, r.Raw)
+		} else {
+			resp, err = upstream.ForwardContext(ctx, r.Msg)
+		}
+		if err != nil {
+			chainLog.Debug("Forward error", "id", r.Msg.Id, "client", r.Client, "error", err)
+			if resp = forwarder.ErrorResponse(r.Msg, err, udpBufferSize); resp == nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	})
+}
+
+// Validate rejects queries that are not a single question with at most an
+// OPT and a TSIG record, like dnshandler.AcceptDNS does for plaintext
+// listeners. NOTIFY and UPDATE messages with a single zone are passed on to
+// be handled by Updates.
+func Validate(udpBufferSize uint16) Stage {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r *Request) (*dns.Msg, error) {
+			req := r.Msg
+			if req.Response {
+				return nil, forwarder.ErrDropped
+			}
+			if req.Opcode != dns.OpcodeQuery && req.Opcode != dns.OpcodeNotify && req.Opcode != dns.OpcodeUpdate {
+				return new(dns.Msg).SetRcode(req, dns.RcodeNotImplemented), nil
+			}
+			if len(req.Question) != 1 {
+				return new(dns.Msg).SetRcode(req, dns.RcodeFormatError), nil
+			}
+			if req.Opcode != dns.OpcodeQuery {
+				// records in the other sections are left to the primary
+				return next.ServeDNS(ctx, r)
+			}
+			extra := len(req.Extra)
+			if req.IsTsig() != nil {
+				extra--
+			}
+			// IXFR queries carry the SOA of the client in the authority section
+			ns := 0
+			if req.Question[0].Qtype == dns.TypeIXFR {
+				ns = 1
+			}
+			if len(req.Answer) != 0 || len(req.Ns) > ns || extra > 1 {
+				return new(dns.Msg).SetRcode(req, dns.RcodeFormatError), nil
+			}
+			if extra != 0 {
+				// the only other extra record allowed is the OPT
+				if opt := req.IsEdns0(); opt == nil {
+					return new(dns.Msg).SetRcode(req, dns.RcodeFormatError), nil
+				} else if opt.Version() != 0 {
+					return new(dns.Msg).SetRcode(req, dns.RcodeBadVers).SetEdns0(udpBufferSize, false), nil
+				}
+			}
+			return next.ServeDNS(ctx, r)
+		})
+	}
+}
+
+// Truncate limits UDP responses to the size the client advertised, between
+// 512 and maxSize bytes
+func Truncate(maxSize uint16) Stage {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r *Request) (*dns.Msg, error) {
+			var udpSize int
+			if opt := r.Msg.IsEdns0(); opt != nil {
+				udpSize = int(opt.UDPSize())
+			}
+
+			resp, err := next.ServeDNS(ctx, r)
+			if resp == nil || r.Transport != "udp" {
+				return resp, err
+			}
+
+			if udpSize < 512 {
+				udpSize = 512
+			} else if udpSize > int(maxSize) {
+				udpSize = int(maxSize)
+			}
+			resp.Truncate(udpSize)
+			return resp, err
+		})
+	}
+}
+
+// Log writes answered queries to the query log, with the upstream recorded
+// by Forward
+func Log(l querylog.Logger) Stage {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, r *Request) (*dns.Msg, error) {
+			start := time.Now()
+			// relayed responses are logged as the first message, counting
+			// the answers of all of them
+			var first *dns.Msg
+			answers := 0
+			if stream := r.Stream; stream != nil {
+				r = r.WithMsg(r.Msg)
+				r.Stream = func(respBytes []byte) error {
+					m := new(dns.Msg)
+					if m.Unpack(respBytes) == nil {
+						if first == nil {
+							first = m
+						}
+						answers += len(m.Answer)
+					}
+					return stream(respBytes)
+				}
+			}
+			resp, err := next.ServeDNS(ctx, r)
+			if resp != nil {
+				entry := querylog.NewEntry(r.Client, r.Transport, r.Upstream(), r.Msg, resp, start)
+				entry.CacheHit = r.CacheHit()
+				l.Log(entry)
+			} else if first != nil {
+				entry := querylog.NewEntry(r.Client, r.Transport, r.Upstream(), r.Msg, first, start)
+				entry.Answers = answers
+				l.Log(entry)
+			}
+			return resp, err
+		})
+	}
+}
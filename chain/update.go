@@ -0,0 +1,84 @@
+package chain
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/miekg/dns"
+)
+
+// UpdatePolicy decides where NOTIFY and UPDATE messages go
+type UpdatePolicy struct {
+	// Forwarder to the primary server, nil to answer NOTIMP
+	Primary forwarder.Forwarder
+	// Networks of the clients allowed to send NOTIFY and UPDATE messages
+	Allow []netip.Prefix
+	// EDNS UDP buffer size advertised in generated responses
+	UDPBufferSize uint16
+}
+
+// ParseNetwork parses an IP address or a prefix such as "192.0.2.0/24"
+func ParseNetwork(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+// Updates forwards NOTIFY and UPDATE messages from allowed clients to the
+// primary, signed ones unchanged like Forward does, instead of passing them
+// on to the rest of the chain. It must follow Validate, which lets them
+// through.
+func Updates(policy UpdatePolicy) Stage {
+	return func(next Handler) Handler {
+		var primary Handler
+		if policy.Primary != nil {
+			primary = Forward(policy.Primary, policy.UDPBufferSize)
+		}
+		return HandlerFunc(func(ctx context.Context, r *Request) (*dns.Msg, error) {
+			req := r.Msg
+			if req.Opcode != dns.OpcodeNotify && req.Opcode != dns.OpcodeUpdate {
+				return next.ServeDNS(ctx, r)
+			}
+			if primary == nil {
+				return new(dns.Msg).SetRcode(req, dns.RcodeNotImplemented), nil
+			}
+			if !policy.allowed(r.Client) {
+				chainLog.Debug("Refused message from client not allowed", "id", req.Id, "client", r.Client, "opcode", dns.OpcodeToString[req.Opcode])
+				return policy.refuse(req), nil
+			}
+			return primary.ServeDNS(ctx, r)
+		})
+	}
+}
+
+func (p UpdatePolicy) allowed(client string) bool {
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(client)
+		if err != nil {
+			return false
+		}
+		addr = addrPort.Addr()
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.Allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p UpdatePolicy) refuse(req *dns.Msg) *dns.Msg {
+	ede := &dns.EDNS0_EDE{
+		InfoCode:  dns.ExtendedErrorCodeProhibited,
+		ExtraText: dns.OpcodeToString[req.Opcode] + " messages are not allowed from this client",
+	}
+	return forwarder.RcodeResponse(req, dns.RcodeRefused, ede, p.UDPBufferSize)
+}
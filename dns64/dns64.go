@@ -0,0 +1,203 @@
+// Package dns64 synthesizes AAAA records from A records for IPv6-only
+// clients behind a NAT64 gateway, following RFC 6147.
+package dns64
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/miekg/dns"
+)
+
+var dns64Log = logging.New("DNS64")
+
+// DefaultPrefix is the well-known prefix of RFC 6052
+var DefaultPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// TTL of synthesized records when the AAAA response carries no SOA
+const defaultTTL = 600
+
+// IPv4-mapped addresses are no real AAAA records and are synthesized over
+var mappedPrefix = netip.MustParsePrefix("::ffff:0:0/96")
+
+type Config struct {
+	// NAT64 prefix, DefaultPrefix if not valid
+	Prefix netip.Prefix
+	// Domains, including their subdomains, never synthesized for
+	Exclude []string
+}
+
+// ParsePrefix parses a NAT64 prefix with one of the lengths allowed by
+// RFC 6052
+func ParsePrefix(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if !p.Addr().Is6() || p.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("not an IPv6 prefix")
+	}
+	switch p.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return netip.Prefix{}, fmt.Errorf("length must be 32, 40, 48, 56, 64, or 96")
+	}
+	p = p.Masked()
+	if p.Addr().As16()[8] != 0 {
+		return netip.Prefix{}, fmt.Errorf("bits 64 to 71 must be zero")
+	}
+	return p, nil
+}
+
+// Stage returns a chain.Stage answering AAAA queries without AAAA records
+// with addresses synthesized from the A records of the name. Clients that
+// set both the DO and CD bits validate answers themselves and get no
+// synthesized records, which could not be validated.
+func Stage(cfg Config) chain.Stage {
+	if !cfg.Prefix.IsValid() {
+		cfg.Prefix = DefaultPrefix
+	}
+	exclude := make(map[string]bool)
+	for _, name := range cfg.Exclude {
+		exclude[dns.CanonicalName(name)] = true
+	}
+
+	return func(next chain.Handler) chain.Handler {
+		return chain.HandlerFunc(func(ctx context.Context, r *chain.Request) (*dns.Msg, error) {
+			req := r.Msg
+			q := req.Question[0]
+			if q.Qtype != dns.TypeAAAA || q.Qclass != dns.ClassINET || req.IsTsig() != nil || excluded(exclude, q.Name) {
+				return next.ServeDNS(ctx, r)
+			}
+			if opt := req.IsEdns0(); opt != nil && opt.Do() && req.CheckingDisabled {
+				return next.ServeDNS(ctx, r)
+			}
+
+			resp, err := next.ServeDNS(ctx, r)
+			if resp == nil || resp.Rcode != dns.RcodeSuccess || hasAAAA(resp) {
+				return resp, err
+			}
+
+			aReq := req.Copy()
+			aReq.Question[0].Qtype = dns.TypeA
+			aResp, aErr := next.ServeDNS(ctx, r.WithMsg(aReq))
+			if aResp == nil || aErr != nil || aResp.Rcode != dns.RcodeSuccess {
+				return resp, err
+			}
+			synth := synthesize(cfg.Prefix, aResp, negativeTTL(resp))
+			if synth == nil {
+				return resp, err
+			}
+			dns64Log.Debug("Synthesized AAAA records", "id", req.Id, "name", q.Name, "records", len(synth.Answer))
+			synth.Id = req.Id
+			synth.Question = req.Question
+			return synth, nil
+		})
+	}
+}
+
+func excluded(exclude map[string]bool, name string) bool {
+	if len(exclude) == 0 {
+		return false
+	}
+	name = dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if exclude[name[off:]] {
+			return true
+		}
+	}
+	return exclude["."]
+}
+
+// hasAAAA reports whether resp answers with AAAA records that are not
+// IPv4-mapped
+func hasAAAA(resp *dns.Msg) bool {
+	for _, rr := range resp.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok {
+			if addr, ok := netip.AddrFromSlice(aaaa.AAAA); ok && !mappedPrefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// negativeTTL returns how long the absence of AAAA records may be cached
+func negativeTTL(resp *dns.Msg) uint32 {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return defaultTTL
+}
+
+// synthesize turns the response to an A query into one to the AAAA query,
+// or returns nil if there are no A records. Signatures of the A records no
+// longer apply and are removed, and the answer is not authenticated anymore.
+func synthesize(prefix netip.Prefix, aResp *dns.Msg, maxTTL uint32) *dns.Msg {
+	resp := aResp.Copy()
+	resp.AuthenticatedData = false
+	resp.Answer = resp.Answer[:0]
+	found := false
+	for _, rr := range aResp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip := rr.A.To4()
+			if ip == nil {
+				continue
+			}
+			ttl := rr.Hdr.Ttl
+			if ttl > maxTTL {
+				ttl = maxTTL
+			}
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: rr.Hdr.Name, Rrtype: dns.TypeAAAA, Class: rr.Hdr.Class, Ttl: ttl},
+				AAAA: embed(prefix, ip),
+			})
+			found = true
+		case *dns.RRSIG:
+			if rr.TypeCovered != dns.TypeA {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		default:
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	// authority and additional records belong to the A query
+	resp.Ns = nil
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+	return resp
+}
+
+// embed places an IPv4 address in the prefix as described in RFC 6052,
+// skipping bits 64 to 71
+func embed(prefix netip.Prefix, ip net.IP) net.IP {
+	b := prefix.Addr().As16()
+	i := prefix.Bits() / 8
+	for _, octet := range ip {
+		if i == 8 {
+			i++
+		}
+		b[i] = octet
+		i++
+	}
+	return net.IP(b[:])
+}
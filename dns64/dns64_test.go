@@ -0,0 +1,220 @@
+package dns64
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/miekg/dns"
+)
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+		ok   bool
+	}{
+		{"64:ff9b::/96", "64:ff9b::/96", true},
+		{"2001:db8:122:344::/64", "2001:db8:122:344::/64", true},
+		{"2001:db8:1::5/48", "2001:db8:1::/48", true},
+		{"2001:db8::/33", "", false},
+		{"2001:db8:0:0:ff00::/96", "", false},
+		{"192.0.2.0/24", "", false},
+		{"::ffff:0:0/96", "", false},
+		{"64:ff9b::", "", false},
+	}
+	for _, tt := range tests {
+		p, err := ParsePrefix(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParsePrefix(%q) error = %v, want ok %v", tt.s, err, tt.ok)
+			continue
+		}
+		if tt.ok && p.String() != tt.want {
+			t.Errorf("ParsePrefix(%q) = %s, want %s", tt.s, p, tt.want)
+		}
+	}
+}
+
+// The examples of RFC 6052 section 2.4
+func TestEmbed(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+	for _, tt := range tests {
+		got := embed(netip.MustParsePrefix(tt.prefix), net.IPv4(192, 0, 2, 33).To4())
+		if want := net.ParseIP(tt.want); !got.Equal(want) {
+			t.Errorf("embed(%s) = %s, want %s", tt.prefix, got, want)
+		}
+	}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestStage(t *testing.T) {
+	soa := "example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 7200 3600 1209600 300"
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		doCD    bool
+		aaaa    []string
+		aaaaNs  []string
+		rcode   int
+		a       []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name:   "synthesized",
+			qname:  "v4.example.org.",
+			qtype:  dns.TypeAAAA,
+			aaaaNs: []string{soa},
+			a:      []string{"v4.example.org. 3600 IN A 192.0.2.33"},
+			want:   []string{"v4.example.org.\t300\tIN\tAAAA\t64:ff9b::c000:221"},
+		},
+		{
+			name:  "TTL of the A record when lower",
+			qname: "v4.example.org.",
+			qtype: dns.TypeAAAA,
+			a:     []string{"v4.example.org. 60 IN A 192.0.2.33"},
+			want:  []string{"v4.example.org.\t60\tIN\tAAAA\t64:ff9b::c000:221"},
+		},
+		{
+			name:  "CNAME kept",
+			qname: "www.example.org.",
+			qtype: dns.TypeAAAA,
+			a: []string{
+				"www.example.org. 60 IN CNAME v4.example.org.",
+				"v4.example.org. 60 IN A 192.0.2.1",
+			},
+			want: []string{
+				"www.example.org.\t60\tIN\tCNAME\tv4.example.org.",
+				"v4.example.org.\t60\tIN\tAAAA\t64:ff9b::c000:201",
+			},
+		},
+		{
+			name:  "real AAAA records",
+			qname: "v6.example.org.",
+			qtype: dns.TypeAAAA,
+			aaaa:  []string{"v6.example.org. 60 IN AAAA 2001:db8::1"},
+			a:     []string{"v6.example.org. 60 IN A 192.0.2.1"},
+			want:  []string{"v6.example.org.\t60\tIN\tAAAA\t2001:db8::1"},
+		},
+		{
+			name:  "IPv4-mapped AAAA records",
+			qname: "mapped.example.org.",
+			qtype: dns.TypeAAAA,
+			aaaa:  []string{"mapped.example.org. 60 IN AAAA ::ffff:192.0.2.1"},
+			a:     []string{"mapped.example.org. 60 IN A 192.0.2.1"},
+			want:  []string{"mapped.example.org.\t60\tIN\tAAAA\t64:ff9b::c000:201"},
+		},
+		{
+			name:  "no A records",
+			qname: "none.example.org.",
+			qtype: dns.TypeAAAA,
+			want:  nil,
+		},
+		{
+			name:  "NXDOMAIN",
+			qname: "nx.example.org.",
+			qtype: dns.TypeAAAA,
+			rcode: dns.RcodeNameError,
+			a:     []string{"nx.example.org. 60 IN A 192.0.2.1"},
+			want:  nil,
+		},
+		{
+			name:    "excluded subdomain",
+			qname:   "v4.example.org.",
+			qtype:   dns.TypeAAAA,
+			a:       []string{"v4.example.org. 60 IN A 192.0.2.1"},
+			exclude: []string{"Example.org"},
+			want:    nil,
+		},
+		{
+			name:    "other domain excluded",
+			qname:   "v4.example.org.",
+			qtype:   dns.TypeAAAA,
+			a:       []string{"v4.example.org. 60 IN A 192.0.2.1"},
+			exclude: []string{"ample.org", "v4.example.com"},
+			want:    []string{"v4.example.org.\t60\tIN\tAAAA\t64:ff9b::c000:201"},
+		},
+		{
+			name:  "validating client",
+			qname: "v4.example.org.",
+			qtype: dns.TypeAAAA,
+			doCD:  true,
+			a:     []string{"v4.example.org. 60 IN A 192.0.2.1"},
+			want:  nil,
+		},
+		{
+			name:  "A query",
+			qname: "v4.example.org.",
+			qtype: dns.TypeA,
+			a:     []string{"v4.example.org. 60 IN A 192.0.2.1"},
+			want:  []string{"v4.example.org.\t60\tIN\tA\t192.0.2.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := chain.HandlerFunc(func(ctx context.Context, r *chain.Request) (*dns.Msg, error) {
+				resp := new(dns.Msg).SetReply(r.Msg)
+				resp.Rcode = tt.rcode
+				records, ns := tt.a, []string(nil)
+				if r.Msg.Question[0].Qtype == dns.TypeAAAA {
+					records, ns = tt.aaaa, tt.aaaaNs
+				}
+				for _, s := range records {
+					resp.Answer = append(resp.Answer, mustRR(t, s))
+				}
+				for _, s := range ns {
+					resp.Ns = append(resp.Ns, mustRR(t, s))
+				}
+				return resp, nil
+			})
+			h := Stage(Config{Exclude: tt.exclude})(next)
+
+			req := new(dns.Msg).SetQuestion(tt.qname, tt.qtype)
+			if tt.doCD {
+				req.SetEdns0(1232, true)
+				req.CheckingDisabled = true
+			}
+			resp, err := h.ServeDNS(context.Background(), &chain.Request{Msg: req, Client: "192.0.2.1:53", Transport: "udp"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Id != req.Id || resp.Question[0] != req.Question[0] {
+				t.Errorf("response does not match the query: %v", resp)
+			}
+			var got []string
+			for _, rr := range resp.Answer {
+				got = append(got, rr.String())
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("answer = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("answer[%d] = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// Package dnshandler serves plaintext DNS clients over UDP and TCP.
+package dnshandler
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/miekg/dns"
+)
+
+type Config struct {
+	// Query processing chain, usually ending with chain.Forward
+	Handler chain.Handler
+	// EDNS UDP buffer size advertised in generated responses
+	UDPBufferSize uint16
+}
+
+// Handler is a dns.Handler passing queries to the chain. Servers should use
+// AcceptDNS as their MsgAcceptFunc, and DecorateReader so that signed
+// messages are forwarded as they were received.
+type Handler struct {
+	Config Config
+	// signed messages in wire format, from DecorateReader to ServeDNS
+	Signed map[signedKey][]byte
+	Mutex  sync.Mutex
+}
+
+type signedKey struct {
+	Client string
+	ID     uint16
+}
+
+func New(cfg Config) *Handler {
+	if cfg.UDPBufferSize == 0 {
+		cfg.UDPBufferSize = 1232
+	}
+	return &Handler{Config: cfg, Signed: make(map[signedKey][]byte)}
+}
+
+func AcceptDNS(dh dns.Header) dns.MsgAcceptAction {
+	if isResponse := dh.Bits&(1<<15) != 0; isResponse {
+		return dns.MsgIgnore
+	}
+	opcode := int(dh.Bits>>11) & 0xF
+	if opcode != dns.OpcodeQuery && opcode != dns.OpcodeNotify && opcode != dns.OpcodeUpdate {
+		return dns.MsgRejectNotImplemented
+	}
+	if dh.Qdcount != 1 {
+		return dns.MsgReject
+	}
+	// NOTIFY and UPDATE messages carry records in the other sections
+	if opcode != dns.OpcodeQuery {
+		return dns.MsgAccept
+	}
+	if dh.Ancount != 0 {
+		return dns.MsgReject
+	}
+	// the SOA of IXFR queries
+	if dh.Nscount > 1 {
+		return dns.MsgReject
+	}
+	// OPT and TSIG
+	if dh.Arcount > 2 {
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+func (h *Handler) ServeDNS(drw dns.ResponseWriter, dr *dns.Msg) {
+	r := &chain.Request{
+		Msg:       dr,
+		Client:    drw.RemoteAddr().String(),
+		Transport: drw.RemoteAddr().Network(),
+	}
+	if dr.IsTsig() != nil {
+		key := signedKey{r.Client, dr.Id}
+		h.Mutex.Lock()
+		r.Raw = h.Signed[key]
+		delete(h.Signed, key)
+		h.Mutex.Unlock()
+	}
+	// UDP responses are always a single message checked by the chain
+	if r.Transport != "udp" {
+		r.Stream = func(resp []byte) error {
+			_, err := drw.Write(resp)
+			return err
+		}
+	}
+	if resp := chain.Resolve(context.Background(), h.Config.Handler, r, h.Config.UDPBufferSize); resp != nil {
+		drw.WriteMsg(resp)
+	}
+}
+
+// DecorateReader is a dns.Server DecorateReader keeping the messages signed
+// with TSIG for ServeDNS in the wire format they were read in
+func (h *Handler) DecorateReader(r dns.Reader) dns.Reader {
+	return &reader{Reader: r, Handler: h}
+}
+
+type reader struct {
+	dns.Reader
+	Handler *Handler
+}
+
+func (r *reader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	m, err := r.Reader.ReadTCP(conn, timeout)
+	if err == nil {
+		r.Handler.keep(conn.RemoteAddr(), m)
+	}
+	return m, err
+}
+
+func (r *reader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	m, session, err := r.Reader.ReadUDP(conn, timeout)
+	if err == nil {
+		r.Handler.keep(session.RemoteAddr(), m)
+	}
+	return m, session, err
+}
+
+// keep stores a copy of m if it is signed and will reach ServeDNS, which
+// removes it again
+func (h *Handler) keep(client net.Addr, m []byte) {
+	if len(m) < 12 {
+		return
+	}
+	dh := dns.Header{
+		Id:      binary.BigEndian.Uint16(m[0:]),
+		Bits:    binary.BigEndian.Uint16(m[2:]),
+		Qdcount: binary.BigEndian.Uint16(m[4:]),
+		Ancount: binary.BigEndian.Uint16(m[6:]),
+		Nscount: binary.BigEndian.Uint16(m[8:]),
+		Arcount: binary.BigEndian.Uint16(m[10:]),
+	}
+	if dh.Arcount == 0 || AcceptDNS(dh) != dns.MsgAccept || lastType(m, dh) != dns.TypeTSIG {
+		return
+	}
+	// messages failing to unpack never reach ServeDNS
+	if err := new(dns.Msg).Unpack(m); err != nil {
+		return
+	}
+	key := signedKey{client.String(), dh.Id}
+	h.Mutex.Lock()
+	// UDP buffers are reused
+	h.Signed[key] = append([]byte(nil), m...)
+	h.Mutex.Unlock()
+}
+
+// lastType returns the type of the last record of m, or 0 if there is none
+// or m is malformed
+func lastType(m []byte, dh dns.Header) uint16 {
+	off := 12
+	var err error
+	for i := 0; i < int(dh.Qdcount); i++ {
+		if _, off, err = dns.UnpackDomainName(m, off); err != nil {
+			return 0
+		}
+		off += 4
+	}
+	var rrtype uint16
+	for i := 0; i < int(dh.Ancount)+int(dh.Nscount)+int(dh.Arcount); i++ {
+		if _, off, err = dns.UnpackDomainName(m, off); err != nil || off+10 > len(m) {
+			return 0
+		}
+		rrtype = binary.BigEndian.Uint16(m[off:])
+		off += 10 + int(binary.BigEndian.Uint16(m[off+8:]))
+	}
+	if off > len(m) {
+		return 0
+	}
+	return rrtype
+}
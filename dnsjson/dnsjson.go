@@ -0,0 +1,154 @@
+// Package dnsjson converts between DNS messages and the JSON format of the
+// Google and Cloudflare DNS over HTTPS JSON APIs, for clients without a DNS
+// wire format encoder. Queries may carry an "id" of any JSON value, which is
+// copied to the response so that clients can match the responses to their
+// queries.
+package dnsjson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Query is a JSON query such as {"name":"example.com","type":"AAAA"}. The
+// type defaults to A and may also be given as a number.
+type Query struct {
+	ID   json.RawMessage `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Type json.RawMessage `json:"type,omitempty"`
+	// Disable DNSSEC validation
+	CD bool `json:"cd,omitempty"`
+	// Ask for DNSSEC records
+	DO bool `json:"do,omitempty"`
+}
+
+type Question struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type RR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type Response struct {
+	ID         json.RawMessage `json:"id,omitempty"`
+	Status     int             `json:"Status"`
+	TC         bool            `json:"TC"`
+	RD         bool            `json:"RD"`
+	RA         bool            `json:"RA"`
+	AD         bool            `json:"AD"`
+	CD         bool            `json:"CD"`
+	Question   []Question      `json:"Question"`
+	Answer     []RR            `json:"Answer,omitempty"`
+	Authority  []RR            `json:"Authority,omitempty"`
+	Additional []RR            `json:"Additional,omitempty"`
+}
+
+// Error is returned instead of a response to queries that cannot be parsed
+type Error struct {
+	ID    json.RawMessage `json:"id,omitempty"`
+	Error string          `json:"error"`
+}
+
+var ErrNoName = errors.New("missing name")
+
+// ParseQuery returns the DNS query of a JSON query, with recursion desired
+// and EDNS with udpBufferSize. The id of the query is returned even if
+// parsing fails past it.
+func ParseQuery(data []byte, udpBufferSize uint16) (*dns.Msg, json.RawMessage, error) {
+	var q Query
+	if err := json.Unmarshal(data, &q); err != nil {
+		return nil, nil, err
+	}
+	if q.Name == "" {
+		return nil, q.ID, ErrNoName
+	}
+	if _, ok := dns.IsDomainName(q.Name); !ok {
+		return nil, q.ID, fmt.Errorf("invalid name %q", q.Name)
+	}
+	qtype, err := parseType(q.Type)
+	if err != nil {
+		return nil, q.ID, err
+	}
+	dnsReq := new(dns.Msg)
+	dnsReq.SetQuestion(dns.Fqdn(q.Name), qtype)
+	dnsReq.CheckingDisabled = q.CD
+	dnsReq.SetEdns0(udpBufferSize, q.DO)
+	return dnsReq, q.ID, nil
+}
+
+// parseType accepts a type name such as "AAAA" or "TYPE28", or a number
+func parseType(raw json.RawMessage) (uint16, error) {
+	if len(raw) == 0 {
+		return dns.TypeA, nil
+	}
+	var name string
+	if err := json.Unmarshal(raw, &name); err != nil {
+		var n uint16
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return 0, fmt.Errorf("invalid type %s", raw)
+		}
+		return n, nil
+	}
+	name = strings.ToUpper(name)
+	if qtype, ok := dns.StringToType[name]; ok {
+		return qtype, nil
+	}
+	if n, err := strconv.ParseUint(strings.TrimPrefix(name, "TYPE"), 10, 16); err == nil {
+		return uint16(n), nil
+	}
+	return 0, fmt.Errorf("unknown type %q", name)
+}
+
+// MarshalResponse returns the JSON response of a DNS response, with the id
+// of its query. The OPT record is left out.
+func MarshalResponse(id json.RawMessage, dnsResp *dns.Msg) ([]byte, error) {
+	resp := Response{
+		ID:         id,
+		Status:     dnsResp.Rcode,
+		TC:         dnsResp.Truncated,
+		RD:         dnsResp.RecursionDesired,
+		RA:         dnsResp.RecursionAvailable,
+		AD:         dnsResp.AuthenticatedData,
+		CD:         dnsResp.CheckingDisabled,
+		Question:   []Question{},
+		Answer:     records(dnsResp.Answer),
+		Authority:  records(dnsResp.Ns),
+		Additional: records(dnsResp.Extra),
+	}
+	for _, q := range dnsResp.Question {
+		resp.Question = append(resp.Question, Question{Name: q.Name, Type: q.Qtype})
+	}
+	return json.Marshal(resp)
+}
+
+// MarshalError returns the JSON error of a query that cannot be parsed
+func MarshalError(id json.RawMessage, err error) ([]byte, error) {
+	return json.Marshal(Error{ID: id, Error: err.Error()})
+}
+
+func records(rrs []dns.RR) []RR {
+	var list []RR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		list = append(list, RR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return list
+}
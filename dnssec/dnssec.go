@@ -0,0 +1,349 @@
+// Package dnssec validates answers against trust anchors. The DNSKEY and DS
+// records needed to build the chain of trust are fetched through the same
+// forwarder that answers client queries.
+package dnssec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/miekg/dns"
+)
+
+var dnssecLog = logging.New("DNSSEC")
+
+// RootAnchors are the DS records of the root zone key signing keys
+const RootAnchors = `. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+const (
+	// upper bound for cached answers and keys
+	maxCacheTTL = time.Hour
+	// how long bogus zone keys are remembered
+	bogusTTL = time.Minute
+)
+
+type Config struct {
+	// Trust anchors as DS or DNSKEY records, RootAnchors if empty
+	Anchors []dns.RR
+	// Maximum number of cached answers, keys and fetched records
+	CacheSize int
+	// EDNS UDP buffer size used when an OPT record has to be added
+	UDPBufferSize uint16
+}
+
+// result is the outcome of validating some data
+type result struct {
+	Secure bool
+	// Bogus data must not be returned to clients
+	Bogus bool
+	// why the data is bogus, or why it is insecure although it is signed
+	EDE *dns.EDNS0_EDE
+}
+
+var secure = result{Secure: true}
+
+func insecure(code uint16, format string, args ...any) result {
+	return result{EDE: &dns.EDNS0_EDE{InfoCode: code, ExtraText: fmt.Sprintf(format, args...)}}
+}
+
+func bogus(code uint16, format string, args ...any) result {
+	return result{Bogus: true, EDE: &dns.EDNS0_EDE{InfoCode: code, ExtraText: fmt.Sprintf(format, args...)}}
+}
+
+// Validator is a chain stage validating responses for clients that did not
+// set the CD bit. Secure answers get the AD bit, bogus ones SERVFAIL with an
+// extended error.
+type Validator struct {
+	Upstream forwarder.Forwarder
+	Config   Config
+	Anchors  map[string][]dns.RR
+	Cache    *cache
+}
+
+func New(upstream forwarder.Forwarder, cfg Config) *Validator {
+	if len(cfg.Anchors) == 0 {
+		cfg.Anchors, _ = ParseAnchors(strings.NewReader(RootAnchors), "")
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = 10000
+	}
+	if cfg.UDPBufferSize == 0 {
+		cfg.UDPBufferSize = 1232
+	}
+	v := &Validator{
+		Upstream: upstream,
+		Config:   cfg,
+		Anchors:  make(map[string][]dns.RR),
+		Cache:    &cache{Size: cfg.CacheSize, Entries: make(map[string]*cacheEntry)},
+	}
+	for _, rr := range cfg.Anchors {
+		zone := dns.CanonicalName(rr.Header().Name)
+		v.Anchors[zone] = append(v.Anchors[zone], rr)
+	}
+	return v
+}
+
+// ParseAnchors reads DS and DNSKEY records in zone file syntax
+func ParseAnchors(r io.Reader, file string) ([]dns.RR, error) {
+	var anchors []dns.RR
+	zp := dns.NewZoneParser(r, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			anchors = append(anchors, rr)
+		default:
+			return nil, fmt.Errorf("%s is not a DS or DNSKEY record", rr.Header().Name)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no trust anchors")
+	}
+	return anchors, nil
+}
+
+func LoadAnchors(path string) ([]dns.RR, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseAnchors(f, path)
+}
+
+// Stage is a chain.Stage validating the responses of the rest of the chain
+func (v *Validator) Stage(next chain.Handler) chain.Handler {
+	return chain.HandlerFunc(func(ctx context.Context, r *chain.Request) (*dns.Msg, error) {
+		req := r.Msg
+		if req.CheckingDisabled || req.IsTsig() != nil || forwarder.IsTransfer(req) {
+			return next.ServeDNS(ctx, r)
+		}
+
+		key := answerKey(req)
+		if e := v.Cache.get(key); e != nil {
+			r.SetCacheHit()
+			return v.reply(req, e.aged(), e.Result), nil
+		}
+
+		out := req.Copy()
+		if opt := out.IsEdns0(); opt == nil {
+			out.SetEdns0(v.Config.UDPBufferSize, true)
+		} else {
+			opt.SetDo()
+		}
+		out.CheckingDisabled = true
+
+		resp, err := next.ServeDNS(ctx, r.WithMsg(out))
+		if resp == nil {
+			return nil, err
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			return v.reply(req, resp, result{}), err
+		}
+
+		res := v.validate(ctx, resp)
+		if res.Bogus {
+			dnssecLog.Debug("Validation failed", "id", req.Id, "name", req.Question[0].Name, "type", dns.TypeToString[req.Question[0].Qtype], "error", res.EDE.ExtraText)
+			return v.failure(req, res), nil
+		}
+		v.Cache.put(key, resp, res, msgTTL(resp))
+		return v.reply(req, resp, res), nil
+	})
+}
+
+// reply adapts a validated response to what the client asked for
+func (v *Validator) reply(req, resp *dns.Msg, res result) *dns.Msg {
+	resp = resp.Copy()
+	resp.Id = req.Id
+	resp.CheckingDisabled = req.CheckingDisabled
+
+	reqOpt := req.IsEdns0()
+	do := reqOpt != nil && reqOpt.Do()
+	resp.AuthenticatedData = res.Secure && (do || req.AuthenticatedData)
+	if !do {
+		qtype := req.Question[0].Qtype
+		resp.Answer = withoutDNSSEC(resp.Answer, qtype)
+		resp.Ns = withoutDNSSEC(resp.Ns, qtype)
+		resp.Extra = withoutDNSSEC(resp.Extra, qtype)
+	}
+
+	if respOpt := resp.IsEdns0(); respOpt != nil {
+		if reqOpt == nil {
+			forwarder.RemoveOPT(resp)
+		} else {
+			if !do {
+				respOpt.Hdr.Ttl &^= 1 << 15
+			}
+			if res.EDE != nil {
+				respOpt.Option = append(respOpt.Option, res.EDE)
+			}
+		}
+	}
+	return resp
+}
+
+func (v *Validator) failure(req *dns.Msg, res result) *dns.Msg {
+	return forwarder.RcodeResponse(req, dns.RcodeServerFailure, res.EDE, v.Config.UDPBufferSize)
+}
+
+// fetch sends a query for DNSSEC records through the upstream
+func (v *Validator) fetch(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	key := "fetch " + name + " " + dns.TypeToString[qtype]
+	if e := v.Cache.get(key); e != nil {
+		return e.Msg, nil
+	}
+
+	req := new(dns.Msg).SetQuestion(name, qtype)
+	req.SetEdns0(v.Config.UDPBufferSize, true)
+	req.CheckingDisabled = true
+	resp, err := v.Upstream.ForwardContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	v.Cache.put(key, resp, result{}, msgTTL(resp))
+	return resp, nil
+}
+
+func answerKey(req *dns.Msg) string {
+	q := req.Question[0]
+	key := fmt.Sprintf("answer %s %d %d", dns.CanonicalName(q.Name), q.Qtype, q.Qclass)
+	// answers may differ per client subnet
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				key += " " + subnet.String()
+			}
+		}
+	}
+	return key
+}
+
+// msgTTL returns how long a response may be cached, 0 if not at all
+func msgTTL(m *dns.Msg) time.Duration {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			t := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > maxCacheTTL {
+		d = maxCacheTTL
+	}
+	return d
+}
+
+type cacheEntry struct {
+	Msg     *dns.Msg
+	Result  result
+	Keys    []*dns.DNSKEY
+	Stored  time.Time
+	Expires time.Time
+}
+
+// aged returns a copy of the cached message with TTLs reduced by the time
+// spent in the cache
+func (e *cacheEntry) aged() *dns.Msg {
+	m := e.Msg.Copy()
+	elapsed := uint32(time.Since(e.Stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > elapsed {
+				rr.Header().Ttl -= elapsed
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	return m
+}
+
+type cache struct {
+	Mutex   sync.Mutex
+	Size    int
+	Entries map[string]*cacheEntry
+}
+
+func (c *cache) get(key string) *cacheEntry {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	e := c.Entries[key]
+	if e == nil {
+		return nil
+	}
+	if time.Now().After(e.Expires) {
+		delete(c.Entries, key)
+		return nil
+	}
+	return e
+}
+
+func (c *cache) put(key string, m *dns.Msg, res result, ttl time.Duration) {
+	c.putEntry(key, &cacheEntry{Msg: m, Result: res}, ttl)
+}
+
+func (c *cache) putEntry(key string, e *cacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	e.Stored = time.Now()
+	e.Expires = e.Stored.Add(ttl)
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if len(c.Entries) >= c.Size {
+		for k, old := range c.Entries {
+			if e.Stored.After(old.Expires) {
+				delete(c.Entries, k)
+			}
+		}
+		// still full, make room at random
+		for k := range c.Entries {
+			if len(c.Entries) < c.Size {
+				break
+			}
+			delete(c.Entries, k)
+		}
+	}
+	c.Entries[key] = e
+}
+
+// withoutDNSSEC removes the DNSSEC records a client did not ask for
+func withoutDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
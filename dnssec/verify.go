@@ -0,0 +1,710 @@
+package dnssec
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NSEC3 hash iterations above this are treated as insecure (RFC 9276)
+const maxNSEC3Iterations = 150
+
+var supportedAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+var supportedDigests = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+type rrsetKey struct {
+	Name string
+	Type uint16
+}
+
+type rrsets struct {
+	Order []rrsetKey
+	Sets  map[rrsetKey][]dns.RR
+	Sigs  map[rrsetKey][]*dns.RRSIG
+}
+
+func groupRRsets(rrs []dns.RR) *rrsets {
+	s := &rrsets{
+		Sets: make(map[rrsetKey][]dns.RR),
+		Sigs: make(map[rrsetKey][]*dns.RRSIG),
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{dns.CanonicalName(h.Name), sig.TypeCovered}
+			s.Sigs[key] = append(s.Sigs[key], sig)
+			continue
+		}
+		key := rrsetKey{dns.CanonicalName(h.Name), h.Rrtype}
+		if _, found := s.Sets[key]; !found {
+			s.Order = append(s.Order, key)
+		}
+		s.Sets[key] = append(s.Sets[key], rr)
+	}
+	return s
+}
+
+// validate checks the answer and authority sections of a response
+func (v *Validator) validate(ctx context.Context, resp *dns.Msg) result {
+	q := resp.Question[0]
+	answer := groupRRsets(resp.Answer)
+	res := secure
+
+	for _, key := range answer.Order {
+		sigs := answer.Sigs[key]
+		if len(sigs) == 0 {
+			if key.Type == dns.TypeCNAME && synthesizedFromDNAME(key.Name, answer) {
+				continue
+			}
+			_, _, r := v.zoneFor(ctx, key.Name, key.Type)
+			if r.Bogus {
+				return r
+			}
+			if r.Secure {
+				return bogus(dns.ExtendedErrorCodeRRSIGsMissing, "No RRSIG for %s %s", key.Name, dns.TypeToString[key.Type])
+			}
+			res = r
+			continue
+		}
+
+		r := v.verifyRRset(ctx, answer.Sets[key], sigs)
+		if r.Bogus {
+			return r
+		}
+		if !r.Secure {
+			res = r
+			continue
+		}
+		if labels := int(sigs[0].Labels); labels < dns.CountLabel(key.Name) {
+			// expanded from a wildcard, the name itself must not exist
+			if r := v.validateWildcard(ctx, resp, key.Name, labels); r.Bogus {
+				return r
+			} else if !r.Secure {
+				res = r
+			}
+		}
+	}
+
+	target := dns.CanonicalName(q.Name)
+	for i := 0; i < len(answer.Order); i++ {
+		cname, found := answer.Sets[rrsetKey{target, dns.TypeCNAME}]
+		if !found || q.Qtype == dns.TypeCNAME {
+			break
+		}
+		target = dns.CanonicalName(cname[0].(*dns.CNAME).Target)
+	}
+	_, answered := answer.Sets[rrsetKey{target, q.Qtype}]
+	if resp.Rcode == dns.RcodeNameError || (!answered && q.Qtype != dns.TypeANY && q.Qtype != dns.TypeCNAME) {
+		r := v.validateDenial(ctx, resp, target, q.Qtype)
+		if r.Bogus {
+			return r
+		}
+		if !r.Secure {
+			res = r
+		}
+	}
+	return res
+}
+
+func synthesizedFromDNAME(name string, answer *rrsets) bool {
+	for key := range answer.Sets {
+		if key.Type == dns.TypeDNAME && dns.IsSubDomain(key.Name, name) && key.Name != name {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyRRset checks the signatures of an RRset with the keys of the zone
+// it belongs to. The zone is found by walking down from a trust anchor, so
+// the signer name of the RRSIGs cannot make the data insecure.
+func (v *Validator) verifyRRset(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG) result {
+	h := rrset[0].Header()
+	zone, keys, res := v.zoneFor(ctx, dns.CanonicalName(h.Name), h.Rrtype)
+	if !res.Secure {
+		return res
+	}
+	return verifyZoneSigs(zone, keys, rrset, sigs)
+}
+
+// verifyZoneSigs checks the signatures made by zone over an RRset
+func verifyZoneSigs(zone string, keys []*dns.DNSKEY, rrset []dns.RR, sigs []*dns.RRSIG) result {
+	var zoneSigs []*dns.RRSIG
+	for _, sig := range sigs {
+		if dns.CanonicalName(sig.SignerName) == zone {
+			zoneSigs = append(zoneSigs, sig)
+		}
+	}
+	if len(zoneSigs) == 0 && len(sigs) != 0 {
+		h := rrset[0].Header()
+		return bogus(dns.ExtendedErrorCodeDNSBogus, "RRSIG for %s %s has invalid signer %s", h.Name, dns.TypeToString[h.Rrtype], sigs[0].SignerName)
+	}
+	return verifySigs(rrset, zoneSigs, keys)
+}
+
+// verifySigs checks the signatures of an RRset with known keys
+func verifySigs(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) result {
+	owner := rrset[0].Header().Name
+	rrtype := dns.TypeToString[rrset[0].Header().Rrtype]
+	res := bogus(dns.ExtendedErrorCodeRRSIGsMissing, "No RRSIG for %s %s", owner, rrtype)
+	unsupported := true
+	now := time.Now()
+
+	for _, sig := range sigs {
+		if !supportedAlgorithms[sig.Algorithm] {
+			continue
+		}
+		unsupported = false
+
+		// key tags are not unique, every matching key has to be tried
+		var candidates []*dns.DNSKEY
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && k.Flags&dns.ZONE != 0 {
+				candidates = append(candidates, k)
+			}
+		}
+		if len(candidates) == 0 {
+			res = bogus(dns.ExtendedErrorCodeDNSKEYMissing, "No DNSKEY %d for RRSIG of %s %s", sig.KeyTag, owner, rrtype)
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			if int32(uint32(now.Unix())-sig.Inception) < 0 {
+				res = bogus(dns.ExtendedErrorCodeSignatureNotYetValid, "RRSIG of %s %s is not yet valid", owner, rrtype)
+			} else {
+				res = bogus(dns.ExtendedErrorCodeSignatureExpired, "RRSIG of %s %s has expired", owner, rrtype)
+			}
+			continue
+		}
+		for _, key := range candidates {
+			if err := sig.Verify(key, rrset); err != nil {
+				res = bogus(dns.ExtendedErrorCodeDNSBogus, "Invalid RRSIG of %s %s: %v", owner, rrtype, err)
+				continue
+			}
+			return secure
+		}
+	}
+
+	if unsupported && len(sigs) != 0 {
+		return insecure(dns.ExtendedErrorCodeUnsupportedDNSKEYAlgorithm, "No supported RRSIG algorithm for %s %s", owner, rrtype)
+	}
+	return res
+}
+
+// zoneKeys returns the validated DNSKEYs of a zone. Unless the zone has a
+// trust anchor, its DS records must be signed by the parent zone with
+// parentKeys.
+func (v *Validator) zoneKeys(ctx context.Context, parent string, parentKeys []*dns.DNSKEY, zone string) ([]*dns.DNSKEY, result) {
+	cacheKey := "keys " + zone
+	if e := v.Cache.get(cacheKey); e != nil {
+		return e.Keys, e.Result
+	}
+
+	keys, ttl, res := v.zoneKeysUncached(ctx, parent, parentKeys, zone)
+	if res.Bogus && res.EDE.InfoCode != dns.ExtendedErrorCodeNetworkError {
+		ttl = bogusTTL
+	}
+	v.Cache.putEntry(cacheKey, &cacheEntry{Keys: keys, Result: res}, ttl)
+	return keys, res
+}
+
+func (v *Validator) zoneKeysUncached(ctx context.Context, parent string, parentKeys []*dns.DNSKEY, zone string) ([]*dns.DNSKEY, time.Duration, result) {
+	trusted, found := v.Anchors[zone]
+	var ttl time.Duration = maxCacheTTL
+	if !found {
+		msg, err := v.fetch(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return nil, 0, bogus(dns.ExtendedErrorCodeNetworkError, "Fetching DS of %s failed: %v", zone, err)
+		}
+		ds := groupRRsets(msg.Answer)
+		key := rrsetKey{zone, dns.TypeDS}
+		if len(ds.Sets[key]) == 0 {
+			// without DS records the zone is insecure, if the parent proves
+			// an insecure delegation
+			res := v.dsDenial(parent, parentKeys, msg, zone)
+			if res.Secure {
+				res = bogus(dns.ExtendedErrorCodeNSECMissing, "No DS for %s and no insecure delegation", zone)
+			}
+			return nil, msgTTL(msg), res
+		}
+		if len(ds.Sigs[key]) == 0 {
+			return nil, 0, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "No RRSIG for %s DS", zone)
+		}
+		if res := verifyZoneSigs(parent, parentKeys, ds.Sets[key], ds.Sigs[key]); !res.Secure {
+			return nil, msgTTL(msg), res
+		}
+		trusted = ds.Sets[key]
+		ttl = msgTTL(msg)
+	}
+
+	msg, err := v.fetch(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, bogus(dns.ExtendedErrorCodeNetworkError, "Fetching DNSKEY of %s failed: %v", zone, err)
+	}
+	dnskey := groupRRsets(msg.Answer)
+	key := rrsetKey{zone, dns.TypeDNSKEY}
+	var keys []*dns.DNSKEY
+	for _, rr := range dnskey.Sets[key] {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	if len(keys) == 0 {
+		return nil, 0, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "No DNSKEY for %s", zone)
+	}
+	if t := msgTTL(msg); t < ttl {
+		ttl = t
+	}
+
+	// zone keys matching the DS records or anchors may sign the DNSKEY
+	// RRset, other keys must not be used for RRSIGs (RFC 4034 section 2.1.1)
+	var entryKeys []*dns.DNSKEY
+	var unsupported uint16 = dns.ExtendedErrorCodeUnsupportedDNSKEYAlgorithm
+	supported := false
+	for _, rr := range trusted {
+		switch t := rr.(type) {
+		case *dns.DS:
+			if !supportedAlgorithms[t.Algorithm] {
+				continue
+			}
+			if !supportedDigests[t.DigestType] {
+				unsupported = dns.ExtendedErrorCodeUnsupportedDSDigestType
+				continue
+			}
+			supported = true
+			for _, k := range keys {
+				if k.KeyTag() != t.KeyTag || k.Algorithm != t.Algorithm || k.Flags&dns.ZONE == 0 {
+					continue
+				}
+				if ds := k.ToDS(t.DigestType); ds != nil && strings.EqualFold(ds.Digest, t.Digest) {
+					entryKeys = append(entryKeys, k)
+				}
+			}
+
+		case *dns.DNSKEY:
+			if !supportedAlgorithms[t.Algorithm] {
+				continue
+			}
+			supported = true
+			for _, k := range keys {
+				if k.Flags == t.Flags && k.Algorithm == t.Algorithm && k.PublicKey == t.PublicKey && k.Flags&dns.ZONE != 0 {
+					entryKeys = append(entryKeys, k)
+				}
+			}
+		}
+	}
+	if !supported {
+		if unsupported == dns.ExtendedErrorCodeUnsupportedDSDigestType {
+			return nil, ttl, insecure(unsupported, "No supported DS digest type for %s", zone)
+		}
+		return nil, ttl, insecure(unsupported, "No supported DNSKEY algorithm for %s", zone)
+	}
+	if len(entryKeys) == 0 {
+		return nil, 0, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "No zone key of %s matches its DS records", zone)
+	}
+	if res := verifySigs(dnskey.Sets[key], dnskey.Sigs[key], entryKeys); !res.Secure {
+		if !res.Bogus {
+			return nil, ttl, res
+		}
+		return nil, 0, res
+	}
+	return keys, ttl, secure
+}
+
+// zoneFor returns the zone that signs the records of owner with the given
+// type, and its keys. DS records belong to the parent side of a zone cut,
+// and NSEC3 owner names are a hash below the zone apex.
+func (v *Validator) zoneFor(ctx context.Context, owner string, rrtype uint16) (string, []*dns.DNSKEY, result) {
+	if rrtype == dns.TypeDS || rrtype == dns.TypeNSEC3 {
+		owner = parentName(owner)
+	}
+	return v.findZone(ctx, owner)
+}
+
+// findZone returns the signed zone name belongs to and its validated keys.
+// It walks down from the closest trust anchor, looking for DS records at
+// every label. The result is insecure if name is not below a trust anchor
+// or below an insecure delegation, in which case unsigned data for it is
+// not bogus.
+func (v *Validator) findZone(ctx context.Context, name string) (string, []*dns.DNSKEY, result) {
+	anchor := ""
+	for zone := range v.Anchors {
+		if dns.IsSubDomain(zone, name) && (anchor == "" || dns.CountLabel(zone) > dns.CountLabel(anchor)) {
+			anchor = zone
+		}
+	}
+	if anchor == "" {
+		return "", nil, result{}
+	}
+	keys, res := v.zoneKeys(ctx, "", nil, anchor)
+	if !res.Secure {
+		return anchor, nil, res
+	}
+
+	zone := anchor
+	labels := dns.Split(name)
+	for i := dns.CountLabel(name) - dns.CountLabel(anchor) - 1; i >= 0; i-- {
+		child := name[labels[i]:]
+		msg, err := v.fetch(ctx, child, dns.TypeDS)
+		if err != nil {
+			return "", nil, bogus(dns.ExtendedErrorCodeNetworkError, "Fetching DS of %s failed: %v", child, err)
+		}
+		if msg.Rcode == dns.RcodeNameError {
+			break
+		}
+
+		ds := groupRRsets(msg.Answer)
+		if len(ds.Sets[rrsetKey{child, dns.TypeDS}]) != 0 {
+			childKeys, res := v.zoneKeys(ctx, zone, keys, child)
+			if !res.Secure {
+				return child, nil, res
+			}
+			zone, keys = child, childKeys
+			continue
+		}
+		if res := v.dsDenial(zone, keys, msg, child); !res.Secure {
+			return child, nil, res
+		}
+	}
+	return zone, keys, secure
+}
+
+// dsDenial checks the denial of DS records for child in msg, which zone
+// must have signed. The result is insecure for an insecure delegation, and
+// secure if child is not a zone cut.
+func (v *Validator) dsDenial(zone string, keys []*dns.DNSKEY, msg *dns.Msg, child string) result {
+	nsecs, nsec3s, signed, res := verifyAuthority(zone, keys, msg)
+	if res.Bogus || (signed && !res.Secure) {
+		return res
+	}
+	if !signed {
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "No signed denial of existence for %s DS", child)
+	}
+	if insecureDelegation(nsecs, nsec3s, child) {
+		return result{}
+	}
+	return secure
+}
+
+// verifyAuthority checks the signatures of zone in the authority section
+// and returns the NSEC and NSEC3 records found there. signed is false if
+// there are no signatures at all.
+func verifyAuthority(zone string, keys []*dns.DNSKEY, msg *dns.Msg) (nsecs []*dns.NSEC, nsec3s []*dns.NSEC3, signed bool, res result) {
+	authority := groupRRsets(msg.Ns)
+	res = secure
+	for _, key := range authority.Order {
+		if len(authority.Sigs[key]) == 0 {
+			switch key.Type {
+			case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+				if signed || len(authority.Sigs) != 0 {
+					return nil, nil, true, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "No RRSIG for %s %s", key.Name, dns.TypeToString[key.Type])
+				}
+			}
+			continue
+		}
+		signed = true
+		r := verifyZoneSigs(zone, keys, authority.Sets[key], authority.Sigs[key])
+		if r.Bogus {
+			return nil, nil, true, r
+		}
+		if !r.Secure {
+			res = r
+			continue
+		}
+		for _, rr := range authority.Sets[key] {
+			switch t := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, t)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, t)
+			}
+		}
+	}
+	return nsecs, nsec3s, signed, res
+}
+
+// validateDenial checks the proof that name has no records of type qtype,
+// or does not exist at all for NXDOMAIN responses
+func (v *Validator) validateDenial(ctx context.Context, msg *dns.Msg, name string, qtype uint16) result {
+	zone, keys, res := v.zoneFor(ctx, name, qtype)
+	if !res.Secure {
+		return res
+	}
+	nsecs, nsec3s, signed, res := verifyAuthority(zone, keys, msg)
+	if !signed {
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "No signed denial of existence for %s %s", name, dns.TypeToString[qtype])
+	}
+	if !res.Secure {
+		return res
+	}
+
+	nxdomain := msg.Rcode == dns.RcodeNameError
+	if len(nsecs) != 0 {
+		if nsecDenies(nsecs, name, qtype, nxdomain) {
+			return secure
+		}
+	} else if len(nsec3s) != 0 {
+		if ok, optOut := nsec3Denies(nsec3s, name, qtype, nxdomain); ok {
+			if optOut {
+				return result{}
+			}
+			return secure
+		}
+	}
+	return bogus(dns.ExtendedErrorCodeNSECMissing, "Invalid denial of existence for %s %s", name, dns.TypeToString[qtype])
+}
+
+// validateWildcard checks the proof that name does not exist for answers
+// expanded from a wildcard with the given number of labels
+func (v *Validator) validateWildcard(ctx context.Context, msg *dns.Msg, name string, labels int) result {
+	zone, keys, res := v.findZone(ctx, name)
+	if !res.Secure {
+		return res
+	}
+	nsecs, nsec3s, signed, res := verifyAuthority(zone, keys, msg)
+	if !signed {
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "No proof that %s does not exist for wildcard answer", name)
+	}
+	if !res.Secure {
+		return res
+	}
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, name) {
+			return secure
+		}
+	}
+	// the next closer name is one label below the wildcard's parent
+	indexes := dns.Split(name)
+	nextCloser := name[indexes[len(indexes)-labels-1]:]
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(nextCloser) {
+			return secure
+		}
+	}
+	return bogus(dns.ExtendedErrorCodeNSECMissing, "No proof that %s does not exist for wildcard answer", name)
+}
+
+func insecureDelegation(nsecs []*dns.NSEC, nsec3s []*dns.NSEC3, name string) bool {
+	for _, nsec := range nsecs {
+		if dns.CanonicalName(nsec.Hdr.Name) == name {
+			return isDelegation(nsec.TypeBitMap)
+		}
+	}
+	for _, nsec3 := range nsec3s {
+		if nsec3.Iterations > maxNSEC3Iterations {
+			return true
+		}
+		if nsec3.Match(name) {
+			return isDelegation(nsec3.TypeBitMap)
+		}
+	}
+	if _, nextCloser, ok := closestEncloser(nsec3s, name); ok {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Flags&1 != 0 && nsec3.Cover(nextCloser) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isDelegation(types []uint16) bool {
+	return hasType(types, dns.TypeNS) && !hasType(types, dns.TypeDS) && !hasType(types, dns.TypeSOA)
+}
+
+func nsecDenies(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, nsec := range nsecs {
+			if dns.CanonicalName(nsec.Hdr.Name) == name {
+				return !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+	}
+
+	var encloser string
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		// an empty non-terminal has no records of any type
+		if !nxdomain && dns.IsSubDomain(name, dns.CanonicalName(nsec.NextDomain)) {
+			return true
+		}
+		for _, other := range []string{nsec.Hdr.Name, nsec.NextDomain} {
+			if ancestor := commonAncestor(name, other); dns.CountLabel(ancestor) > dns.CountLabel(encloser) || encloser == "" {
+				encloser = ancestor
+			}
+		}
+	}
+	if encloser == "" {
+		return false
+	}
+
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+	for _, nsec := range nsecs {
+		if nxdomain && nsecCovers(nsec, wildcard) {
+			return true
+		}
+		if !nxdomain && dns.CanonicalName(nsec.Hdr.Name) == wildcard {
+			return !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	return false
+}
+
+func nsec3Denies(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) (ok bool, optOut bool) {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Iterations > maxNSEC3Iterations {
+			return true, true
+		}
+	}
+
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				return !hasType(nsec3.TypeBitMap, qtype) && !hasType(nsec3.TypeBitMap, dns.TypeCNAME), false
+			}
+		}
+	}
+
+	encloser, nextCloser, found := closestEncloser(nsec3s, name)
+	if !found {
+		return false, false
+	}
+	covered := false
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(nextCloser) {
+			covered = true
+			optOut = nsec3.Flags&1 != 0
+			break
+		}
+	}
+	if !covered {
+		return false, false
+	}
+	// an opt-out span may hide unsigned delegations
+	if !nxdomain && qtype == dns.TypeDS && optOut {
+		return true, true
+	}
+
+	wildcard := "*." + encloser
+	if encloser == "." {
+		wildcard = "*."
+	}
+	for _, nsec3 := range nsec3s {
+		if nxdomain && nsec3.Cover(wildcard) {
+			return true, optOut
+		}
+		if !nxdomain && nsec3.Match(wildcard) {
+			return !hasType(nsec3.TypeBitMap, qtype) && !hasType(nsec3.TypeBitMap, dns.TypeCNAME), false
+		}
+	}
+	return false, false
+}
+
+// closestEncloser finds the longest existing ancestor of name proven by a
+// matching NSEC3 record, and the name one label below it
+func closestEncloser(nsec3s []*dns.NSEC3, name string) (encloser, nextCloser string, found bool) {
+	indexes := dns.Split(name)
+	for i := 1; i <= len(indexes); i++ {
+		candidate := "."
+		if i < len(indexes) {
+			candidate = name[indexes[i]:]
+		}
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(candidate) {
+				return candidate, name[indexes[i-1]:], true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// nsecCovers tells whether name falls between the owner and next name of
+// an NSEC record in canonical order
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// the last NSEC of a zone points back to the apex
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare orders names as in RFC 4034 section 6.1, comparing
+// their labels in wire format
+func canonicalCompare(a, b string) int {
+	la, lb := canonicalLabels(a), canonicalLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := bytes.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// canonicalLabels returns the unescaped labels of name with ASCII letters
+// in lower case
+func canonicalLabels(name string) [][]byte {
+	wire := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), wire, 0, nil, false)
+	if err != nil {
+		return nil
+	}
+	var labels [][]byte
+	for i := 0; i < n && wire[i] != 0; i += int(wire[i]) + 1 {
+		label := wire[i+1 : i+1+int(wire[i])]
+		for j, c := range label {
+			if 'A' <= c && c <= 'Z' {
+				label[j] = c + 'a' - 'A'
+			}
+		}
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// parentName returns name without its first label
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
+
+func commonAncestor(a, b string) string {
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+	indexes := dns.Split(a)
+	return dns.CanonicalName(a[indexes[len(indexes)-n]:])
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
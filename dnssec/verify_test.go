@@ -0,0 +1,400 @@
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a zone signed with a single key
+type testZone struct {
+	Name string
+	Key  *dns.DNSKEY
+	Priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string, flags uint16) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{Name: name, Key: key, Priv: priv.(crypto.Signer)}
+}
+
+// signAt signs an RRset with the given validity period
+func (z *testZone) signAt(t *testing.T, inception, expiration time.Time, rrset ...dns.RR) *dns.RRSIG {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  z.Key.Algorithm,
+		KeyTag:     z.Key.KeyTag(),
+		SignerName: z.Name,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.Priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// signed returns an RRset followed by its signature
+func (z *testZone) signed(t *testing.T, rrset ...dns.RR) []dns.RR {
+	t.Helper()
+	now := time.Now()
+	return append(rrset, z.signAt(t, now.Add(-time.Hour), now.Add(time.Hour), rrset...))
+}
+
+// keys returns the DNSKEY response of the zone, publishing extra keys
+// before its own
+func (z *testZone) keys(t *testing.T, extra ...dns.RR) *dns.Msg {
+	t.Helper()
+	return &dns.Msg{Answer: z.signed(t, append(extra, z.Key)...)}
+}
+
+func (z *testZone) ds() *dns.DS {
+	return z.Key.ToDS(dns.SHA256)
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// hashed returns the NSEC3 owner name of name, hashed without salt and
+// iterations
+func hashed(name, zone string) string {
+	return dns.HashName(name, dns.SHA1, 0, "") + "." + zone
+}
+
+// fakeUpstream answers from fixed responses, and with NXDOMAIN for names
+// it does not know
+type fakeUpstream map[string]*dns.Msg
+
+func (f fakeUpstream) Address() string {
+	return "192.0.2.53:53"
+}
+
+func (f fakeUpstream) ForwardContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	resp := &dns.Msg{}
+	if m, found := f[q.Name+" "+dns.TypeToString[q.Qtype]]; found {
+		resp = m.Copy()
+	} else {
+		resp.Rcode = dns.RcodeNameError
+	}
+	resp.Id = req.Id
+	resp.Response = true
+	resp.Question = req.Question
+	return resp, nil
+}
+
+func (f fakeUpstream) Close() {}
+
+// collidingKey returns a key with the key tag of k but another public key
+func collidingKey(t *testing.T, k *dns.DNSKEY) *dns.DNSKEY {
+	t.Helper()
+	pub, err := base64.StdEncoding.DecodeString(k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the key tag is a sum over 16 bit words, swapping bytes two apart
+	// keeps it
+	for i := 0; i+2 < len(pub); i++ {
+		if pub[i] != pub[i+2] {
+			pub[i], pub[i+2] = pub[i+2], pub[i]
+			break
+		}
+	}
+	other := dns.Copy(k).(*dns.DNSKEY)
+	other.PublicKey = base64.StdEncoding.EncodeToString(pub)
+	if other.KeyTag() != k.KeyTag() || other.PublicKey == k.PublicKey {
+		t.Fatal("no colliding key")
+	}
+	return other
+}
+
+func TestValidate(t *testing.T) {
+	const ksk = dns.ZONE | dns.SEP
+	root := newTestZone(t, "example.", ksk)
+	sec := newTestZone(t, "sec.example.", ksk)
+	collide := newTestZone(t, "collide.example.", ksk)
+	nozone := newTestZone(t, "nozone.example.", dns.SEP)
+	n3 := newTestZone(t, "n3.example.", ksk)
+	forged := newTestZone(t, "www.sec.example.", ksk)
+
+	n3Apex := newRR(t, hashed("n3.example.", "n3.example.")+" 3600 IN NSEC3 1 0 0 - "+dns.HashName("n3.example.", dns.SHA1, 0, "")+" NS SOA RRSIG DNSKEY NSEC3PARAM")
+	// spans covering every other hash
+	n3Span := newRR(t, "00000000000000000000000000000000.n3.example. 3600 IN NSEC3 1 0 0 - VVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVV NS")
+	n3OptOut := newRR(t, "00000000000000000000000000000000.n3.example. 3600 IN NSEC3 1 1 0 - VVVVVVVVVVVVVVVVVVVVVVVVVVVVVVVV NS")
+
+	upstream := fakeUpstream{
+		"example. DNSKEY":           root.keys(t),
+		"sec.example. DS":           {Answer: root.signed(t, sec.ds())},
+		"sec.example. DNSKEY":       sec.keys(t),
+		"collide.example. DS":       {Answer: root.signed(t, collide.ds())},
+		"collide.example. DNSKEY":   collide.keys(t, collidingKey(t, collide.Key)),
+		"nozone.example. DS":        {Answer: root.signed(t, nozone.ds())},
+		"nozone.example. DNSKEY":    nozone.keys(t),
+		"n3.example. DS":            {Answer: root.signed(t, n3.ds())},
+		"n3.example. DNSKEY":        n3.keys(t),
+		"insec.example. DS":         {Ns: root.signed(t, newRR(t, "insec.example. 3600 IN NSEC n3.example. NS RRSIG NSEC"))},
+		"optout.n3.example. DS":     {Ns: append(n3.signed(t, n3Apex), n3.signed(t, n3OptOut)...)},
+		"www.sec.example. DS":       {Ns: sec.signed(t, newRR(t, "www.sec.example. 3600 IN NSEC sec.example. A RRSIG NSEC"))},
+		"www.sec.example. DNSKEY":   forged.keys(t),
+		"www.insec.example. DS":     {},
+		"www.optout.n3.example. DS": {},
+	}
+	v := New(upstream, Config{Anchors: []dns.RR{root.Key}})
+
+	a := newRR(t, "www.sec.example. 3600 IN A 192.0.2.1")
+	now := time.Now()
+
+	type want string
+	const (
+		wantSecure   want = "secure"
+		wantInsecure want = "insecure"
+		wantBogus    want = "bogus"
+	)
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+		want   want
+		code   uint16
+	}{
+		{
+			name:   "secure",
+			qname:  "www.sec.example.",
+			qtype:  dns.TypeA,
+			answer: sec.signed(t, a),
+			want:   wantSecure,
+		},
+		{
+			name:   "changed record",
+			qname:  "www.sec.example.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{newRR(t, "www.sec.example. 3600 IN A 192.0.2.2"), sec.signed(t, a)[1]},
+			want:   wantBogus,
+			code:   dns.ExtendedErrorCodeDNSBogus,
+		},
+		{
+			name:   "expired signature",
+			qname:  "www.sec.example.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{a, sec.signAt(t, now.Add(-2*time.Hour), now.Add(-time.Hour), a)},
+			want:   wantBogus,
+			code:   dns.ExtendedErrorCodeSignatureExpired,
+		},
+		{
+			name:   "signature not yet valid",
+			qname:  "www.sec.example.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{a, sec.signAt(t, now.Add(time.Hour), now.Add(2*time.Hour), a)},
+			want:   wantBogus,
+			code:   dns.ExtendedErrorCodeSignatureNotYetValid,
+		},
+		{
+			name:   "missing signature",
+			qname:  "www.sec.example.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{a},
+			want:   wantBogus,
+			code:   dns.ExtendedErrorCodeRRSIGsMissing,
+		},
+		{
+			// the forger's DS lookup is denied by a real NSEC record
+			name:   "forged signer name",
+			qname:  "www.sec.example.",
+			qtype:  dns.TypeA,
+			answer: forged.signed(t, a),
+			want:   wantBogus,
+			code:   dns.ExtendedErrorCodeDNSBogus,
+		},
+		{
+			name:   "insecure delegation",
+			qname:  "www.insec.example.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{newRR(t, "www.insec.example. 3600 IN A 192.0.2.1")},
+			want:   wantInsecure,
+		},
+		{
+			name:  "NSEC NODATA",
+			qname: "www.sec.example.",
+			qtype: dns.TypeTXT,
+			ns:    sec.signed(t, newRR(t, "www.sec.example. 3600 IN NSEC sec.example. A RRSIG NSEC")),
+			want:  wantSecure,
+		},
+		{
+			name:  "NSEC NODATA with the type",
+			qname: "www.sec.example.",
+			qtype: dns.TypeTXT,
+			ns:    sec.signed(t, newRR(t, "www.sec.example. 3600 IN NSEC sec.example. A TXT RRSIG NSEC")),
+			want:  wantBogus,
+			code:  dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name:  "NSEC NXDOMAIN",
+			qname: "nx.sec.example.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns: append(sec.signed(t, newRR(t, "mail.sec.example. 3600 IN NSEC *.wild.sec.example. A RRSIG NSEC")),
+				sec.signed(t, newRR(t, "sec.example. 3600 IN NSEC mail.sec.example. NS SOA RRSIG NSEC DNSKEY"))...),
+			want: wantSecure,
+		},
+		{
+			name:  "NSEC NXDOMAIN without wildcard proof",
+			qname: "nx.sec.example.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    sec.signed(t, newRR(t, "mail.sec.example. 3600 IN NSEC *.wild.sec.example. A RRSIG NSEC")),
+			want:  wantBogus,
+			code:  dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name:  "wildcard",
+			qname: "a.wild.sec.example.",
+			qtype: dns.TypeA,
+			answer: func() []dns.RR {
+				rrs := sec.signed(t, newRR(t, "*.wild.sec.example. 3600 IN A 192.0.2.1"))
+				for _, rr := range rrs {
+					rr.Header().Name = "a.wild.sec.example."
+				}
+				return rrs
+			}(),
+			ns:   sec.signed(t, newRR(t, "*.wild.sec.example. 3600 IN NSEC www.sec.example. A RRSIG NSEC")),
+			want: wantSecure,
+		},
+		{
+			name:  "wildcard without proof",
+			qname: "a.wild.sec.example.",
+			qtype: dns.TypeA,
+			answer: func() []dns.RR {
+				rrs := sec.signed(t, newRR(t, "*.wild.sec.example. 3600 IN A 192.0.2.1"))
+				for _, rr := range rrs {
+					rr.Header().Name = "a.wild.sec.example."
+				}
+				return rrs
+			}(),
+			want: wantBogus,
+			code: dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name:  "NSEC3 NODATA",
+			qname: "www.n3.example.",
+			qtype: dns.TypeTXT,
+			ns:    n3.signed(t, newRR(t, hashed("www.n3.example.", "n3.example.")+" 3600 IN NSEC3 1 0 0 - 00000000000000000000000000000000 A RRSIG")),
+			want:  wantSecure,
+		},
+		{
+			name:  "NSEC3 NXDOMAIN",
+			qname: "nx.n3.example.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    append(n3.signed(t, n3Apex), n3.signed(t, n3Span)...),
+			want:  wantSecure,
+		},
+		{
+			name:  "NSEC3 NXDOMAIN without closest encloser",
+			qname: "nx.n3.example.",
+			qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    n3.signed(t, n3Span),
+			want:  wantBogus,
+			code:  dns.ExtendedErrorCodeNSECMissing,
+		},
+		{
+			name:   "NSEC3 opt-out delegation",
+			qname:  "www.optout.n3.example.",
+			qtype:  dns.TypeA,
+			answer: []dns.RR{newRR(t, "www.optout.n3.example. 3600 IN A 192.0.2.1")},
+			want:   wantInsecure,
+		},
+		{
+			name:   "key tag collision",
+			qname:  "www.collide.example.",
+			qtype:  dns.TypeA,
+			answer: collide.signed(t, newRR(t, "www.collide.example. 3600 IN A 192.0.2.1")),
+			want:   wantSecure,
+		},
+		{
+			name:   "key without zone flag",
+			qname:  "www.nozone.example.",
+			qtype:  dns.TypeA,
+			answer: nozone.signed(t, newRR(t, "www.nozone.example. 3600 IN A 192.0.2.1")),
+			want:   wantBogus,
+			code:   dns.ExtendedErrorCodeDNSKEYMissing,
+		},
+	}
+	for _, tt := range tests {
+		resp := new(dns.Msg).SetQuestion(tt.qname, tt.qtype)
+		resp.Response = true
+		resp.Rcode = tt.rcode
+		resp.Answer = tt.answer
+		resp.Ns = tt.ns
+
+		res := v.validate(context.Background(), resp)
+		got := wantInsecure
+		if res.Secure {
+			got = wantSecure
+		} else if res.Bogus {
+			got = wantBogus
+		}
+		if got != tt.want {
+			t.Errorf("%s: %s (%v), want %s", tt.name, got, res.EDE, tt.want)
+			continue
+		}
+		if tt.want == wantBogus && res.EDE.InfoCode != tt.code {
+			t.Errorf("%s: extended error %v, want code %d", tt.name, res.EDE, tt.code)
+		}
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// RFC 4034 section 6.1, in order
+	names := []string{
+		"example.",
+		"a.example.",
+		"yljkjljk.a.example.",
+		"Z.a.example.",
+		"zABC.a.EXAMPLE.",
+		"z.example.",
+		`\001.z.example.`,
+		"*.z.example.",
+		`\200.z.example.`,
+	}
+	for i := range names {
+		for j := range names {
+			c := canonicalCompare(names[i], names[j])
+			if (i < j && c >= 0) || (i > j && c <= 0) || (i == j && c != 0) {
+				t.Errorf("canonicalCompare(%q, %q) = %d", names[i], names[j], c)
+			}
+		}
+	}
+
+	// an escaped dot is part of the label
+	if c := canonicalCompare(`a\.b.example.`, "a.b.example."); c >= 0 {
+		t.Errorf(`canonicalCompare("a\.b.example.", "a.b.example.") = %d`, c)
+	}
+	if c := canonicalCompare(`\065.example.`, "a.example."); c != 0 {
+		t.Errorf(`canonicalCompare("\065.example.", "a.example.") = %d`, c)
+	}
+}
@@ -0,0 +1,311 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/miekg/dns"
+)
+
+var dnsForwarderLog = logging.New("DNSForwarder")
+
+type DNSForwarder struct {
+	Addr        string
+	TLSConfig   *tls.Config
+	Config      Config
+	TLSConnPool []*dns.Conn
+	Mutex       sync.Mutex
+	Closed      bool
+}
+
+// NewDNSForwarder returns a forwarder for a plaintext upstream, or a DNS over
+// TLS upstream if tlsConfig is not nil
+func NewDNSForwarder(addr string, tlsConfig *tls.Config, cfg Config) *DNSForwarder {
+	cfg.setDefaults()
+	return &DNSForwarder{
+		Addr:      addr,
+		TLSConfig: tlsConfig,
+		Config:    cfg,
+	}
+}
+
+func (d *DNSForwarder) Address() string {
+	if d.TLSConfig != nil {
+		return "tls://" + d.Addr
+	}
+	return d.Addr
+}
+
+func (d *DNSForwarder) ForwardContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return d.ForwardRawContext(ctx, req, nil)
+}
+
+func (d *DNSForwarder) ForwardRawContext(ctx context.Context, req *dns.Msg, reqBytes []byte) (*dns.Msg, error) {
+	if d.Closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.Config.Timeout)
+	defer cancel()
+
+	// leave the request as we found it for the caller, and signed requests
+	// as they are
+	reqOpt := req.IsEdns0()
+	var key *TSIGKey
+	if req.IsTsig() == nil {
+		reqBytes = nil
+		key = d.Config.TSIGKey
+		req = req.Copy()
+		if reqOpt == nil {
+			req.SetEdns0(d.Config.UDPBufferSize, false)
+		} else {
+			req.IsEdns0().SetUDPSize(d.Config.UDPBufferSize)
+		}
+		if d.TLSConfig != nil {
+			Pad(req, QueryPaddingBlock)
+		} else {
+			RemovePadding(req)
+		}
+	}
+
+	var resp *dns.Msg
+	var err error
+	client := &dns.Client{Timeout: d.Config.Timeout}
+
+	if d.TLSConfig == nil {
+		resp, err = exchange(ctx, client, req, reqBytes, d.Addr, key)
+		if err == nil && resp.Truncated {
+			client.Net = "tcp"
+			resp, err = exchange(ctx, client, req, reqBytes, d.Addr, key)
+		}
+	} else {
+		var conn *dns.Conn
+		d.Mutex.Lock()
+		if l := len(d.TLSConnPool); l != 0 {
+			conn = d.TLSConnPool[l-1]
+			d.TLSConnPool = d.TLSConnPool[:l-1]
+		}
+		d.Mutex.Unlock()
+
+		if conn != nil {
+			resp, err = exchangeWithConn(ctx, req, reqBytes, conn, key)
+			if err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+
+		if conn == nil && ctx.Err() == nil {
+			conn, err = d.dial(ctx)
+			if err == nil {
+				resp, err = exchangeWithConn(ctx, req, reqBytes, conn, key)
+				if err != nil {
+					conn.Close()
+				}
+			}
+		}
+
+		if err == nil {
+			d.Mutex.Lock()
+			d.TLSConnPool = append(d.TLSConnPool, conn)
+			d.Mutex.Unlock()
+		}
+	}
+
+	if errors.Is(err, ErrBadSignature) {
+		dnsForwarderLog.Warn("Exchange error", "addr", d.Address(), "id", req.Id, "error", err)
+		return nil, err
+	}
+	if err != nil {
+		dnsForwarderLog.Debug("Exchange error", "addr", d.Address(), "id", req.Id, "error", err)
+		return nil, exchangeError(ctx, err)
+	}
+
+	respOpt := resp.IsEdns0()
+	if respOpt != nil && resp.IsTsig() == nil {
+		RemovePadding(resp)
+		if reqOpt == nil {
+			// remove OPT from response since the original request did not have one
+			RemoveOPT(resp)
+		} else if d.Config.UDPBufferSize < respOpt.UDPSize() {
+			respOpt.SetUDPSize(d.Config.UDPBufferSize)
+		}
+	}
+
+	return resp, nil
+}
+
+// dial opens a TCP, or TLS, connection to the upstream
+func (d *DNSForwarder) dial(ctx context.Context) (*dns.Conn, error) {
+	client := &dns.Client{Net: "tcp", Timeout: d.Config.Timeout}
+	if d.TLSConfig != nil {
+		client.Net = "tcp-tls"
+		client.TLSConfig = d.TLSConfig
+		if d.Config.BootstrapServer != "" {
+			client.Dialer = &net.Dialer{
+				Timeout:  d.Config.Timeout,
+				Resolver: bootstrapResolver(d.Config.BootstrapServer),
+			}
+		}
+	}
+	return client.DialContext(ctx, d.Addr)
+}
+
+// RelayContext sends req over a new TCP, or TLS, connection. Unsigned
+// queries are signed if there is a key, and the responses relayed without
+// the signature once verified. Signed queries are sent as reqBytes if known.
+func (d *DNSForwarder) RelayContext(ctx context.Context, req *dns.Msg, reqBytes []byte, send func(resp []byte) error) error {
+	if d.Closed {
+		return ErrClosed
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, d.Config.Timeout)
+	conn, err := d.dial(dialCtx)
+	cancel()
+	if err != nil {
+		dnsForwarderLog.Debug("Dial error", "addr", d.Address(), "id", req.Id, "error", err)
+		return exchangeError(ctx, err)
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+
+	var session *TSIGSession
+	if req.IsTsig() == nil {
+		reqBytes = nil
+		if d.Config.TSIGKey != nil {
+			session = &TSIGSession{Key: d.Config.TSIGKey}
+		}
+	}
+	reqBytes, err = packQuery(req, reqBytes, session)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(d.Config.Timeout))
+	if _, err := conn.Write(reqBytes); err != nil {
+		return exchangeError(ctx, err)
+	}
+
+	t := newTransfer(req)
+	for {
+		// the timeout applies to each message of a zone transfer
+		conn.SetReadDeadline(time.Now().Add(d.Config.Timeout))
+		respBytes, err := conn.ReadMsgHeader(nil)
+		if err != nil {
+			dnsForwarderLog.Debug("Read error", "addr", d.Address(), "id", req.Id, "error", err)
+			return exchangeError(ctx, err)
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(respBytes); err != nil {
+			return err
+		}
+		if resp.Id != req.Id {
+			continue
+		}
+		if session != nil {
+			if err := session.Verify(respBytes, resp); err != nil {
+				dnsForwarderLog.Warn("Relay error", "addr", d.Address(), "id", req.Id, "error", err)
+				return fmt.Errorf("%w: %v", ErrBadSignature, err)
+			}
+			if respBytes, err = resp.Pack(); err != nil {
+				return err
+			}
+		}
+		if err := send(respBytes); err != nil {
+			return err
+		}
+		if t.last(resp) {
+			return nil
+		}
+	}
+}
+
+// exchange sends req over a new connection to addr
+func exchange(ctx context.Context, client *dns.Client, req *dns.Msg, reqBytes []byte, addr string, key *TSIGKey) (*dns.Msg, error) {
+	conn, err := client.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeWithConn(ctx, req, reqBytes, conn, key)
+}
+
+// exchangeWithConn is client.ExchangeWithConn, but also gives up when ctx is
+// done. TSIG records are left alone unless req is signed with key here, the
+// response must then be signed too and is returned without the signature.
+// reqBytes, if not nil, is the wire format of a req signed by the client.
+func exchangeWithConn(ctx context.Context, req *dns.Msg, reqBytes []byte, conn *dns.Conn, key *TSIGKey) (*dns.Msg, error) {
+	defer watchContext(ctx, conn)()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+	var session *TSIGSession
+	if key != nil {
+		session = &TSIGSession{Key: key}
+	}
+	reqBytes, err := packQuery(req, reqBytes, session)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(reqBytes); err != nil {
+		return nil, err
+	}
+	for {
+		respBytes, err := conn.ReadMsgHeader(nil)
+		if err != nil {
+			return nil, err
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(respBytes); err != nil {
+			return nil, err
+		}
+		// skip late responses to earlier queries
+		if resp.Id != req.Id {
+			continue
+		}
+		if session != nil {
+			if err := session.Verify(respBytes, resp); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+			}
+		}
+		return resp, nil
+	}
+}
+
+// watchContext interrupts reads and writes on conn once ctx is done, until
+// the returned function is called
+func watchContext(ctx context.Context, conn *dns.Conn) func() {
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+		close(stopped)
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func (d *DNSForwarder) Close() {
+	d.Mutex.Lock()
+	d.Closed = true
+	for _, conn := range d.TLSConnPool {
+		conn.Close()
+	}
+	d.TLSConnPool = nil
+	d.Mutex.Unlock()
+}
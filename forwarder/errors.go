@@ -0,0 +1,94 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrTimeout     = errors.New("timeout")
+	ErrBusy        = errors.New("too busy")
+	ErrClosed      = errors.New("forwarder closed")
+	ErrUnreachable = errors.New("upstream unreachable")
+	// ErrDropped means the query must not be answered at all
+	ErrDropped = errors.New("query dropped")
+	// ErrBadSignature means a response failed TSIG verification
+	ErrBadSignature = errors.New("response signature not valid")
+)
+
+// unreachableError keeps the message of the underlying network error while
+// matching ErrUnreachable
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unreachableError) Unwrap() error {
+	return e.err
+}
+
+func (e *unreachableError) Is(target error) bool {
+	return target == ErrUnreachable
+}
+
+// exchangeError maps an error from talking to an upstream to one of the
+// errors above, or to ctx.Err() if the caller gave up
+func exchangeError(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrTimeout
+	}
+	return &unreachableError{err}
+}
+
+// ErrorResponse returns the response to send when ForwardContext fails with
+// err, or nil if the query should go unanswered
+func ErrorResponse(req *dns.Msg, err error, udpBufferSize uint16) *dns.Msg {
+	var rcode int
+	var text string
+	switch {
+	case errors.Is(err, ErrDropped), errors.Is(err, ErrClosed), errors.Is(err, context.Canceled):
+		return nil
+	case errors.Is(err, ErrBusy):
+		rcode, text = dns.RcodeRefused, "Too busy, try again later"
+	case errors.Is(err, ErrTimeout), errors.Is(err, ErrUnreachable):
+		rcode, text = dns.RcodeServerFailure, "No response from upstream: "+err.Error()
+	case errors.Is(err, ErrBadSignature):
+		rcode, text = dns.RcodeServerFailure, "Upstream "+err.Error()
+	default:
+		rcode = dns.RcodeServerFailure
+	}
+
+	var ede *dns.EDNS0_EDE
+	if text != "" {
+		ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther, ExtraText: text}
+	}
+	return RcodeResponse(req, rcode, ede, udpBufferSize)
+}
+
+// RcodeResponse returns a response to req without records, with rcode and,
+// if the query has an OPT record, the optional extended error ede. The OPT
+// record of the response advertises udpBufferSize and keeps the DO bit of
+// the query.
+func RcodeResponse(req *dns.Msg, rcode int, ede *dns.EDNS0_EDE, udpBufferSize uint16) *dns.Msg {
+	resp := new(dns.Msg).SetRcode(req, rcode)
+	resp.RecursionAvailable = true
+	if reqOpt := req.IsEdns0(); reqOpt != nil {
+		respOpt := resp.SetEdns0(udpBufferSize, reqOpt.Do()).IsEdns0()
+		if ede != nil {
+			respOpt.Option = append(respOpt.Option, ede)
+		}
+	}
+	return resp
+}
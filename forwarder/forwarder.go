@@ -0,0 +1,219 @@
+// Package forwarder sends DNS queries to plaintext, TLS and WebSocket
+// upstream servers.
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/framing"
+	"github.com/dnschecktool/dow-proxy/internal/netutil"
+	"github.com/miekg/dns"
+)
+
+// Forwarder sends a query upstream and returns the response. On failure the
+// error is one of the Err values of this package, or ctx.Err() if the caller
+// gave up; ErrorResponse turns it into an answer for the client.
+type Forwarder interface {
+	Address() string
+	ForwardContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+	Close()
+}
+
+// Relayer is implemented by forwarders that can pass responses on exactly
+// as they were received, as needed for zone transfers answered with a
+// stream of messages, and for messages signed with TSIG
+type Relayer interface {
+	// RelayContext sends req upstream without changing it, and passes the
+	// responses in wire format to send, with the ID of req, until the last
+	// message of a zone transfer or the single response to other queries.
+	// Only unsigned queries are signed with Config.TSIGKey, the signatures of
+	// their responses are verified and removed. reqBytes is req in wire
+	// format as the client sent it, or nil; see RawForwarder.
+	RelayContext(ctx context.Context, req *dns.Msg, reqBytes []byte, send func(resp []byte) error) error
+}
+
+// RawForwarder is implemented by forwarders that can send a query signed by
+// the client in the wire format it was received in. Packing the message
+// again may change it, such as its name compression, and break the
+// signature.
+type RawForwarder interface {
+	// ForwardRawContext is ForwardContext for req received as reqBytes,
+	// which are sent instead of req if it is signed
+	ForwardRawContext(ctx context.Context, req *dns.Msg, reqBytes []byte) (*dns.Msg, error)
+}
+
+// Config holds the settings shared by all forwarders. Zero values are
+// replaced with the defaults of the dow-proxy command.
+type Config struct {
+	// Maximum time to wait for network activities
+	Timeout time.Duration
+	// EDNS UDP buffer size advertised upstream and in generated responses
+	UDPBufferSize uint16
+	// WebSocket read and write buffer size
+	WSBufferSize int
+	// Maximum number of open requests per WebSocket
+	RequestsPerWebSocket int
+	// Maximum size in bytes of the responses to a relayed query, such as a
+	// zone transfer, received from a WebSocket upstream but not sent to the
+	// client yet. The relay is aborted with ErrBusy beyond it, as the
+	// responses to other queries on the WebSocket must not wait.
+	RelayBufferSize int
+	// Optional plaintext DNS server "IP:port" used to resolve upstream host names
+	BootstrapServer string
+	// Skip server certificate verification for encrypted upstreams
+	Insecure bool
+	// WebSocket subprotocols offered to upstreams in order of preference,
+	// framing.Default if nil. Upstreams selecting none use framing.V1.
+	Subprotocols []string
+	// Maximum size of a WebSocket message carrying a batch of queries
+	BatchSize int
+	// Maximum time a query waits for others to be batched with
+	BatchDelay time.Duration
+	// Offer permessage-deflate compression to WebSocket upstreams, without
+	// context takeover
+	Compression bool
+	// Compression level from 1 (fastest) to 9 (smallest)
+	CompressionLevel int
+	// WebSocket messages smaller than this many bytes are sent uncompressed
+	CompressionMinSize int
+	// Open WebSockets to wss:// upstreams with HTTP/2 extended CONNECT
+	// (RFC 8441) where supported, sharing one connection
+	HTTP2 bool
+	// Optional key signing queries, whose responses must then be signed with
+	// it too. Queries signed already are sent as they are.
+	TSIGKey *TSIGKey
+}
+
+func (c *Config) setDefaults() {
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.UDPBufferSize == 0 {
+		c.UDPBufferSize = 1232
+	}
+	if c.WSBufferSize == 0 {
+		c.WSBufferSize = 512
+	}
+	if c.RequestsPerWebSocket == 0 {
+		c.RequestsPerWebSocket = 50
+	}
+	if c.RelayBufferSize == 0 {
+		c.RelayBufferSize = 1 << 20
+	}
+	if c.Subprotocols == nil {
+		c.Subprotocols = framing.Default
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = 4096
+	}
+	if c.BatchDelay == 0 {
+		c.BatchDelay = time.Millisecond
+	}
+	if c.CompressionLevel == 0 {
+		c.CompressionLevel = 1
+	}
+	if c.CompressionMinSize == 0 {
+		c.CompressionMinSize = 256
+	}
+}
+
+// New returns a forwarder for an upstream given as an IP address, or a
+// tls://, ws:// or wss:// URL. It returns nil if s is not acceptable.
+func New(s string, cfg Config) Forwarder {
+	if hostPort := netutil.HostPort(s, 53, true, true); hostPort != "" {
+		return NewDNSForwarder(hostPort, nil, cfg)
+	}
+	if url, err := url.Parse(s); err == nil {
+		if url.String() == "tls://"+url.Host {
+			return NewDNSForwarder(netutil.HostPort(url.Host, 853, true, false), clientTLSConfig(cfg.Insecure), cfg)
+		}
+		if url.Scheme == "ws" {
+			url.Host = netutil.HostPort(url.Host, 80, true, false)
+			return NewWebSocketForwarder(url.String(), nil, cfg)
+		}
+		if url.Scheme == "wss" {
+			url.Host = netutil.HostPort(url.Host, 443, true, false)
+			return NewWebSocketForwarder(url.String(), clientTLSConfig(cfg.Insecure), cfg)
+		}
+	}
+	return nil
+}
+
+func clientTLSConfig(insecure bool) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		InsecureSkipVerify: insecure,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+}
+
+// bootstrapResolver resolves host names using only the given server
+func bootstrapResolver(server string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// FailoverForwarder sends queries to the first healthy upstream, in the
+// order they were configured
+type FailoverForwarder struct {
+	Upstreams []Forwarder
+	// Healthy reports whether Upstreams[i] should receive queries
+	Healthy func(i int) bool
+}
+
+// Current returns the upstream receiving queries now
+func (f *FailoverForwarder) Current() Forwarder {
+	for i, upstream := range f.Upstreams {
+		if f.Healthy(i) {
+			return upstream
+		}
+	}
+	// nothing is healthy, keep trying the primary
+	return f.Upstreams[0]
+}
+
+func (f *FailoverForwarder) Address() string {
+	return f.Current().Address()
+}
+
+func (f *FailoverForwarder) ForwardContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return f.Current().ForwardContext(ctx, req)
+}
+
+func (f *FailoverForwarder) ForwardRawContext(ctx context.Context, req *dns.Msg, reqBytes []byte) (*dns.Msg, error) {
+	upstream := f.Current()
+	if r, ok := upstream.(RawForwarder); ok {
+		return r.ForwardRawContext(ctx, req, reqBytes)
+	}
+	return upstream.ForwardContext(ctx, req)
+}
+
+func (f *FailoverForwarder) RelayContext(ctx context.Context, req *dns.Msg, reqBytes []byte, send func(resp []byte) error) error {
+	if r, ok := f.Current().(Relayer); ok {
+		return r.RelayContext(ctx, req, reqBytes, send)
+	}
+	return ErrUnreachable
+}
+
+func (f *FailoverForwarder) Close() {
+	for _, upstream := range f.Upstreams {
+		upstream.Close()
+	}
+}
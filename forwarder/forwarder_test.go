@@ -0,0 +1,211 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+)
+
+// signedUpdate returns an UPDATE signed by a client with testKey, packed
+// with name compression as clients do, and the client's session
+func signedUpdate(t *testing.T) (*dns.Msg, []byte, *TSIGSession) {
+	t.Helper()
+	req := new(dns.Msg).SetUpdate("example.org.")
+	req.Insert([]dns.RR{
+		newRR(t, "www.example.org. 300 IN A 192.0.2.1"),
+		newRR(t, "www.example.org. 300 IN A 192.0.2.2"),
+		newRR(t, "mail.example.org. 300 IN A 192.0.2.3"),
+	})
+	req.Compress = true
+	client := &TSIGSession{Key: testKey}
+	reqBytes, err := client.Sign(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := unpack(t, reqBytes)
+	if b, _ := received.Pack(); bytes.Equal(b, reqBytes) {
+		t.Fatal("packing the message again does not change it")
+	}
+	return received, reqBytes, client
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// signedReply answers a query signed with testKey with a signed response,
+// or NOTAUTH if the signature does not verify
+func signedReply(t *testing.T, reqBytes []byte) []byte {
+	req := new(dns.Msg)
+	if err := req.Unpack(reqBytes); err != nil {
+		t.Error(err)
+		return nil
+	}
+	resp := new(dns.Msg).SetReply(req)
+	tsig := req.IsTsig()
+	if tsig == nil || dns.TsigVerify(reqBytes, testKey.Secret, "", false) != nil {
+		resp.Rcode = dns.RcodeNotAuth
+		b, _ := resp.Pack()
+		return b
+	}
+	resp.SetTsig(testKey.Name, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	b, _, err := dns.TsigGenerate(resp, testKey.Secret, tsig.MAC, false)
+	if err != nil {
+		t.Error(err)
+	}
+	return b
+}
+
+// dnsUpstream answers like signedReply over UDP and TCP
+func dnsUpstream(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server verifies signed queries as received, and signs responses
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		resp := new(dns.Msg).SetReply(m)
+		if m.IsTsig() == nil || w.TsigStatus() != nil {
+			resp.Rcode = dns.RcodeNotAuth
+		} else {
+			resp.SetTsig(testKey.Name, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+		}
+		w.WriteMsg(resp)
+	})
+	secrets := map[string]string{testKey.Name: testKey.Secret}
+	// UPDATE included
+	accept := func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }
+	servers := []*dns.Server{
+		{PacketConn: pc, Handler: handler, TsigSecret: secrets, MsgAcceptFunc: accept},
+		{Listener: l, Handler: handler, TsigSecret: secrets, MsgAcceptFunc: accept},
+	}
+	for _, srv := range servers {
+		srv := srv
+		go srv.ActivateAndServe()
+		t.Cleanup(func() { srv.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+// wsUpstream serves signedReply over WebSocket
+func wsUpstream(t *testing.T) string {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, reqBytes, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, signedReply(t, reqBytes)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws://" + strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestSignedQueriesUnchanged(t *testing.T) {
+	dnsAddr := dnsUpstream(t)
+	wsAddr := wsUpstream(t)
+	forwarders := []struct {
+		name string
+		f    interface {
+			Forwarder
+			RawForwarder
+			Relayer
+		}
+	}{
+		{"dns", NewDNSForwarder(dnsAddr, nil, Config{Timeout: time.Second})},
+		{"websocket", NewWebSocketForwarder(wsAddr, nil, Config{Timeout: time.Second})},
+	}
+
+	for _, tt := range forwarders {
+		defer tt.f.Close()
+
+		req, reqBytes, _ := signedUpdate(t)
+		resp, err := tt.f.ForwardRawContext(context.Background(), req, reqBytes)
+		if err != nil {
+			t.Errorf("%s: ForwardRawContext error: %v", tt.name, err)
+		} else if resp.Rcode != dns.RcodeSuccess || resp.Id != req.Id {
+			t.Errorf("%s: ForwardRawContext response %s with ID %d, want NOERROR with %d", tt.name, dns.RcodeToString[resp.Rcode], resp.Id, req.Id)
+		}
+
+		req, reqBytes, client := signedUpdate(t)
+		var relayed [][]byte
+		err = tt.f.RelayContext(context.Background(), req, reqBytes, func(respBytes []byte) error {
+			relayed = append(relayed, respBytes)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: RelayContext error: %v", tt.name, err)
+			continue
+		}
+		if len(relayed) != 1 {
+			t.Errorf("%s: relayed %d responses, want 1", tt.name, len(relayed))
+			continue
+		}
+		relayedResp := unpack(t, relayed[0])
+		if relayedResp.Rcode != dns.RcodeSuccess || relayedResp.Id != req.Id {
+			t.Errorf("%s: relayed response %s with ID %d, want NOERROR with %d", tt.name, dns.RcodeToString[relayedResp.Rcode], relayedResp.Id, req.Id)
+			continue
+		}
+		// the client checks the relayed response against its own query
+		if err := client.Verify(relayed[0], relayedResp); err != nil {
+			t.Errorf("%s: relayed response does not verify: %v", tt.name, err)
+		}
+	}
+}
+
+func TestRelayBufferSize(t *testing.T) {
+	ws := NewWebSocketForwarder("ws://192.0.2.1", nil, Config{RelayBufferSize: 100})
+	s := newStream()
+	ws.Streams[1] = s
+	msg := func() []byte {
+		b := make([]byte, 40)
+		b[1] = 1
+		return b
+	}
+
+	ws.dispatch(msg())
+	ws.dispatch(msg())
+	if len(s.Queue) != 2 || s.Queued != 80 {
+		t.Fatalf("queued %d messages of %d bytes, want 2 of 80", len(s.Queue), s.Queued)
+	}
+	// the client catches up
+	if ws.pop(s) == nil || s.Queued != 40 {
+		t.Fatalf("queued %d bytes after pop, want 40", s.Queued)
+	}
+	ws.dispatch(msg())
+	ws.dispatch(msg())
+	select {
+	case <-s.Aborted:
+		if s.Err != ErrBusy {
+			t.Errorf("aborted with %v, want %v", s.Err, ErrBusy)
+		}
+	default:
+		t.Error("not aborted beyond RelayBufferSize")
+	}
+}
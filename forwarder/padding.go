@@ -0,0 +1,69 @@
+package forwarder
+
+import "github.com/miekg/dns"
+
+// Block sizes recommended by RFC 8467
+const (
+	QueryPaddingBlock    = 128
+	ResponsePaddingBlock = 468
+)
+
+// Pad adds an EDNS padding option so that the packed size of m is a
+// multiple of blockSize. Messages without an OPT record are left alone, as
+// are messages signed with TSIG, whose signature would no longer match.
+func Pad(m *dns.Msg, blockSize int) {
+	opt := m.IsEdns0()
+	if opt == nil || m.IsTsig() != nil {
+		return
+	}
+	RemovePadding(m)
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	if l := m.Len() % blockSize; l != 0 {
+		padding.Padding = make([]byte, blockSize-l)
+	}
+}
+
+// RemovePadding removes EDNS padding options and reports whether there were
+// any. Messages signed with TSIG are left alone.
+func RemovePadding(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	if opt == nil || m.IsTsig() != nil {
+		return false
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0PADDING {
+			options = append(options, o)
+		}
+	}
+	removed := len(options) != len(opt.Option)
+	opt.Option = options
+	return removed
+}
+
+// IsPadded reports whether m has an EDNS padding option
+func IsPadded(m *dns.Msg) bool {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0PADDING {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RemoveOPT removes the OPT record, for responses to queries without one.
+// Messages signed with TSIG are left alone.
+func RemoveOPT(m *dns.Msg) {
+	if m.IsTsig() != nil {
+		return
+	}
+	for i := len(m.Extra) - 1; i >= 0; i-- {
+		if m.Extra[i].Header().Rrtype == dns.TypeOPT {
+			m.Extra = append(m.Extra[:i], m.Extra[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package forwarder
+
+import (
+	"github.com/miekg/dns"
+)
+
+// IsTransfer reports whether m is an AXFR or IXFR query, answered with a
+// stream of messages
+func IsTransfer(m *dns.Msg) bool {
+	if len(m.Question) != 1 {
+		return false
+	}
+	qtype := m.Question[0].Qtype
+	return qtype == dns.TypeAXFR || qtype == dns.TypeIXFR
+}
+
+// transfer follows the responses to a query to find the last one. Zone
+// transfers end with the SOA record they started with: AXFR and IXFR
+// responses in AXFR format after the second SOA, incremental IXFR responses
+// after the SOA closing the last difference sequence.
+type transfer struct {
+	Qtype uint16
+	First *dns.SOA
+	// SOA records seen after the first one
+	SOAs        int
+	Incremental bool
+	Records     int
+}
+
+func newTransfer(req *dns.Msg) *transfer {
+	t := &transfer{}
+	if IsTransfer(req) {
+		t.Qtype = req.Question[0].Qtype
+	}
+	return t
+}
+
+// last reports whether m is the last response
+func (t *transfer) last(m *dns.Msg) bool {
+	if t.Qtype == 0 || m.Rcode != dns.RcodeSuccess {
+		return true
+	}
+	for _, rr := range m.Answer {
+		t.Records++
+		soa, ok := rr.(*dns.SOA)
+		if t.First == nil {
+			if !ok {
+				// not a zone transfer after all
+				return true
+			}
+			t.First = soa
+			continue
+		}
+		if t.Records == 2 {
+			// IXFR difference sequences start with the old SOA
+			t.Incremental = ok && soa.Serial != t.First.Serial
+		}
+		if !ok {
+			continue
+		}
+		t.SOAs++
+		if soa.Serial != t.First.Serial {
+			continue
+		}
+		// in difference sequences the old and new SOA alternate, the
+		// closing SOA comes after an even number of them
+		if !t.Incremental || t.SOAs%2 == 1 {
+			return true
+		}
+	}
+	// an IXFR response with just the SOA means the client is up to date
+	return t.First == nil || (t.Records == 1 && t.Qtype == dns.TypeIXFR)
+}
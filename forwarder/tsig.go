@@ -0,0 +1,153 @@
+package forwarder
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Allowed difference in seconds between the clocks of signer and verifier
+const tsigFudge = 300
+
+// TSIGKey is a key for TSIG signatures with HMAC-SHA256
+type TSIGKey struct {
+	// Key name as a fully qualified domain name
+	Name string
+	// Base64 encoded secret
+	Secret string
+}
+
+// LoadTSIGKeys reads keys from a file with one key per line, given as
+// "hmac-sha256:name:secret" like dig -y does. Empty lines and lines starting
+// with # are skipped. The keys are mapped by their canonical name.
+func LoadTSIGKeys(path string) (map[string]*TSIGKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]*TSIGKey)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected \"hmac-sha256:name:secret\"", n)
+		}
+		if !strings.EqualFold(fields[0], "hmac-sha256") {
+			return nil, fmt.Errorf("line %d: unsupported algorithm %q", n, fields[0])
+		}
+		if _, ok := dns.IsDomainName(fields[1]); !ok || fields[1] == "" {
+			return nil, fmt.Errorf("line %d: invalid key name %q", n, fields[1])
+		}
+		if _, err := base64.StdEncoding.DecodeString(fields[2]); err != nil || fields[2] == "" {
+			return nil, fmt.Errorf("line %d: secret is not base64", n)
+		}
+		name := dns.CanonicalName(fields[1])
+		keys[name] = &TSIGKey{Name: name, Secret: fields[2]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return keys, nil
+}
+
+// TSIGSession signs and verifies the messages of one exchange: a query and
+// its responses, each signature covering the one before
+type TSIGSession struct {
+	Key      *TSIGKey
+	MAC      string
+	Messages int
+}
+
+// Sign returns m packed with a signature, leaving m itself unchanged
+func (s *TSIGSession) Sign(m *dns.Msg) ([]byte, error) {
+	m.SetTsig(s.Key.Name, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	// the TSIG record is taken out of m again
+	b, mac, err := dns.TsigGenerate(m, s.Key.Secret, s.MAC, s.Messages > 1)
+	if err != nil {
+		return nil, err
+	}
+	s.MAC = mac
+	s.Messages++
+	return b, nil
+}
+
+// Verify checks the signature of m, unpacked from b, and removes it from m
+func (s *TSIGSession) Verify(b []byte, m *dns.Msg) error {
+	t := m.IsTsig()
+	if t == nil {
+		return dns.ErrNoSig
+	}
+	if dns.CanonicalName(t.Hdr.Name) != s.Key.Name || !strings.EqualFold(t.Algorithm, dns.HmacSHA256) {
+		return dns.ErrSecret
+	}
+	if err := dns.TsigVerify(b, s.Key.Secret, s.MAC, s.Messages > 1); err != nil {
+		return err
+	}
+	s.MAC = t.MAC
+	s.Messages++
+	m.Extra = m.Extra[:len(m.Extra)-1]
+	return nil
+}
+
+// packMsg packs m, signed if session is not nil
+func packMsg(m *dns.Msg, session *TSIGSession) ([]byte, error) {
+	if session == nil {
+		return m.Pack()
+	}
+	return session.Sign(m)
+}
+
+// packQuery returns reqBytes, the wire format of a query signed by the
+// client, with the ID of m, or m packed with packMsg if reqBytes is nil.
+// Signatures cover the original ID kept in the TSIG record, so the ID may
+// change.
+func packQuery(m *dns.Msg, reqBytes []byte, session *TSIGSession) ([]byte, error) {
+	if reqBytes == nil {
+		return packMsg(m, session)
+	}
+	b := append([]byte(nil), reqBytes...)
+	binary.BigEndian.PutUint16(b, m.Id)
+	return b, nil
+}
+
+// TSIGErrorResponse returns the unsigned NOTAUTH response to a query whose
+// signature failed verification with err
+func TSIGErrorResponse(req *dns.Msg, err error) *dns.Msg {
+	t := req.IsTsig()
+	resp := new(dns.Msg).SetRcode(req, dns.RcodeNotAuth)
+	if t == nil {
+		return resp
+	}
+	tsigErr := dns.RcodeBadSig
+	switch err {
+	case dns.ErrSecret:
+		tsigErr = dns.RcodeBadKey
+	case dns.ErrTime:
+		tsigErr = dns.RcodeBadTime
+	}
+	resp.Extra = append(resp.Extra, &dns.TSIG{
+		Hdr:        dns.RR_Header{Name: t.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm:  t.Algorithm,
+		TimeSigned: uint64(time.Now().Unix()),
+		Fudge:      t.Fudge,
+		OrigId:     req.Id,
+		Error:      uint16(tsigErr),
+	})
+	return resp
+}
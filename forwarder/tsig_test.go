@@ -0,0 +1,162 @@
+package forwarder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var testKey = &TSIGKey{Name: "transfer.example.org.", Secret: "c2VjcmV0IGtleSBmb3IgdGVzdGluZyBvbmx5"}
+
+// unpack returns the message of b, failing the test if it does not unpack
+func unpack(t *testing.T, b []byte) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// signedExchange signs a query and a stream of n responses, verifying each
+// on the other side
+func signedExchange(t *testing.T, n int) {
+	client := &TSIGSession{Key: testKey}
+	server := &TSIGSession{Key: testKey}
+
+	req := new(dns.Msg).SetQuestion("example.org.", dns.TypeAXFR)
+	reqBytes, err := client.Sign(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.IsTsig() != nil {
+		t.Fatal("Sign left the TSIG record in the message")
+	}
+	received := unpack(t, reqBytes)
+	if err := server.Verify(reqBytes, received); err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if received.IsTsig() != nil {
+		t.Fatal("Verify left the TSIG record in the message")
+	}
+
+	for i := 0; i < n; i++ {
+		resp := new(dns.Msg).SetReply(received)
+		rr, _ := dns.NewRR("example.org. 3600 IN NS ns.example.org.")
+		resp.Answer = append(resp.Answer, rr)
+		respBytes, err := server.Sign(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Verify(respBytes, unpack(t, respBytes)); err != nil {
+			t.Fatalf("response %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestTSIGSession(t *testing.T) {
+	t.Run("single response", func(t *testing.T) { signedExchange(t, 1) })
+	t.Run("zone transfer", func(t *testing.T) { signedExchange(t, 5) })
+}
+
+func TestTSIGSessionRejects(t *testing.T) {
+	otherSecret := &TSIGKey{Name: testKey.Name, Secret: "b3RoZXIgc2VjcmV0"}
+	otherName := &TSIGKey{Name: "other.example.org.", Secret: testKey.Secret}
+
+	sign := func(key *TSIGKey) []byte {
+		req := new(dns.Msg).SetQuestion("example.org.", dns.TypeSOA)
+		b, err := (&TSIGSession{Key: key}).Sign(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name string
+		b    func() []byte
+		want error
+	}{
+		{"unsigned", func() []byte {
+			b, _ := new(dns.Msg).SetQuestion("example.org.", dns.TypeSOA).Pack()
+			return b
+		}, dns.ErrNoSig},
+		{"other key name", func() []byte { return sign(otherName) }, dns.ErrSecret},
+		{"other secret", func() []byte { return sign(otherSecret) }, dns.ErrSig},
+		{"changed message", func() []byte {
+			b := sign(testKey)
+			// the recursion desired flag
+			b[2] ^= 1
+			return b
+		}, dns.ErrSig},
+	}
+	for _, tt := range tests {
+		b := tt.b()
+		if err := (&TSIGSession{Key: testKey}).Verify(b, unpack(t, b)); err != tt.want {
+			t.Errorf("%s: Verify error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestTSIGSessionChained(t *testing.T) {
+	// a response signed for another query does not verify
+	client := &TSIGSession{Key: testKey}
+	req := new(dns.Msg).SetQuestion("example.org.", dns.TypeSOA)
+	if _, err := client.Sign(req); err != nil {
+		t.Fatal(err)
+	}
+
+	other := &TSIGSession{Key: testKey}
+	otherBytes, err := other.Sign(new(dns.Msg).SetQuestion("example.org.", dns.TypeSOA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &TSIGSession{Key: testKey}
+	if err := server.Verify(otherBytes, unpack(t, otherBytes)); err != nil {
+		t.Fatal(err)
+	}
+	respBytes, err := server.Sign(new(dns.Msg).SetReply(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Verify(respBytes, unpack(t, respBytes)); err != dns.ErrSig {
+		t.Errorf("Verify error = %v, want %v", err, dns.ErrSig)
+	}
+}
+
+func TestLoadTSIGKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    int
+		ok      bool
+	}{
+		{"keys", "# comment\n\nhmac-sha256:Transfer.example.org:c2VjcmV0\nHMAC-SHA256:update.:c2VjcmV0\n", 2, true},
+		{"no keys", "# comment\n", 0, false},
+		{"other algorithm", "hmac-md5:transfer.example.org:c2VjcmV0\n", 0, false},
+		{"missing field", "hmac-sha256:c2VjcmV0\n", 0, false},
+		{"invalid secret", "hmac-sha256:transfer.example.org:not base64!\n", 0, false},
+		{"empty name", "hmac-sha256::c2VjcmV0\n", 0, false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "keys")
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := LoadTSIGKeys(path)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if len(keys) != tt.keys {
+			t.Errorf("%s: %d keys, want %d", tt.name, len(keys), tt.keys)
+		}
+	}
+
+	keys, err := LoadTSIGKeys(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Errorf("missing file: %d keys, want error", len(keys))
+	}
+}
@@ -0,0 +1,599 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/framing"
+	"github.com/dnschecktool/dow-proxy/internal/extconnect"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+)
+
+var wsForwarderLog = logging.New("WebSocketForwarder")
+
+type WebSocketForwarder struct {
+	Addr      string
+	TLSConfig *tls.Config
+	Config    Config
+	// HTTP/2 transport opening WebSockets with extended CONNECT, nil unless
+	// Config.HTTP2 is set and the upstream is encrypted
+	Transport *http2.Transport
+	Semaphore chan bool
+	Waiting   map[uint16]chan []byte
+	Streams   map[uint16]*stream
+	Mutex     sync.Mutex
+	Routines  sync.WaitGroup
+	Conn      *websocket.Conn
+	Framing   framing.Framing
+	Batcher   *framing.Batcher
+	Closed    bool
+}
+
+func NewWebSocketForwarder(addr string, tlsConfig *tls.Config, cfg Config) *WebSocketForwarder {
+	cfg.setDefaults()
+	ws := &WebSocketForwarder{
+		Addr:      addr,
+		TLSConfig: tlsConfig,
+		Config:    cfg,
+		Semaphore: make(chan bool, cfg.RequestsPerWebSocket),
+		Waiting:   make(map[uint16]chan []byte, cfg.RequestsPerWebSocket),
+		Streams:   make(map[uint16]*stream),
+	}
+	if cfg.HTTP2 && tlsConfig != nil {
+		ws.Transport = &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				d := &tls.Dialer{NetDialer: ws.netDialer(), Config: cfg}
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return ws
+}
+
+// stream receives the responses to a relayed query. Queue and Queued are
+// guarded by the mutex of the forwarder.
+type stream struct {
+	// responses not sent to the client yet, and their size in bytes
+	Queue  [][]byte
+	Queued int
+	// signalled when Queue grows
+	Ready chan bool
+	// closed when the relay must be aborted with Err, such as when the
+	// client fell more than Config.RelayBufferSize bytes behind
+	Aborted chan bool
+	Err     error
+}
+
+func newStream() *stream {
+	return &stream{
+		Ready:   make(chan bool, 1),
+		Aborted: make(chan bool),
+	}
+}
+
+func (ws *WebSocketForwarder) Address() string {
+	return ws.Addr
+}
+
+func (ws *WebSocketForwarder) ForwardContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return ws.ForwardRawContext(ctx, req, nil)
+}
+
+func (ws *WebSocketForwarder) ForwardRawContext(ctx context.Context, req *dns.Msg, reqBytes []byte) (*dns.Msg, error) {
+	if ws.Closed {
+		return nil, ErrClosed
+	}
+
+	select {
+	case ws.Semaphore <- true:
+		defer func() { <-ws.Semaphore }()
+
+	default:
+		wsForwarderLog.Debug("Maximum open requests reached, refusing query", "id", req.Id)
+		return nil, ErrBusy
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ws.Config.Timeout)
+	defer cancel()
+
+	// send a copy with a unique id, padded on encrypted connections and
+	// signed if there is a key, unless it is signed already
+	reqOpt := req.IsEdns0()
+	out := req.Copy()
+	var session *TSIGSession
+	if out.IsTsig() == nil {
+		reqBytes = nil
+		if ws.Config.TSIGKey != nil {
+			session = &TSIGSession{Key: ws.Config.TSIGKey}
+		}
+		if ws.TLSConfig != nil {
+			if reqOpt == nil {
+				out.SetEdns0(ws.Config.UDPBufferSize, false)
+			}
+			Pad(out, QueryPaddingBlock)
+		} else {
+			RemovePadding(out)
+		}
+	}
+
+	ws.Mutex.Lock()
+	out.Id = ws.uniqueID()
+	reqBytes, err := packQuery(out, reqBytes, session)
+	if err != nil {
+		wsForwarderLog.Error("Pack error", "id", req.Id, "error", err)
+		ws.Mutex.Unlock()
+		return nil, err
+	}
+
+	respChan := make(chan []byte, 1)
+	ws.Waiting[out.Id] = respChan
+	if err := ws.send(reqBytes); err != nil {
+		delete(ws.Waiting, out.Id)
+		ws.Mutex.Unlock()
+		return nil, err
+	}
+	ws.Mutex.Unlock()
+
+	select {
+	case respBytes, ok := <-respChan:
+		if !ok {
+			// the query was batched for a connection that failed
+			return nil, ErrUnreachable
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(respBytes); err != nil {
+			wsForwarderLog.Warn("Unpack error (invalid message)", "id", out.Id, "error", err)
+			return nil, &unreachableError{err}
+		}
+		if session != nil {
+			if err := session.Verify(respBytes, resp); err != nil {
+				wsForwarderLog.Warn("Verify error", "id", out.Id, "original_id", req.Id, "error", err)
+				return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+			}
+		}
+		resp.Id = req.Id
+		RemovePadding(resp)
+		if reqOpt == nil {
+			RemoveOPT(resp)
+		}
+		return resp, nil
+
+	case <-ctx.Done():
+		wsForwarderLog.Debug("Gave up waiting for response", "id", out.Id, "original_id", req.Id, "error", ctx.Err())
+		ws.Mutex.Lock()
+		delete(ws.Waiting, out.Id)
+		ws.Mutex.Unlock()
+		return nil, exchangeError(ctx, ctx.Err())
+	}
+}
+
+// RelayContext sends a copy of req with a unique ID, signed if there is a
+// key and it is unsigned, and relays the responses with the original ID.
+// Signed queries are sent as reqBytes if known, with only the ID changed.
+func (ws *WebSocketForwarder) RelayContext(ctx context.Context, req *dns.Msg, reqBytes []byte, send func(resp []byte) error) error {
+	if ws.Closed {
+		return ErrClosed
+	}
+
+	select {
+	case ws.Semaphore <- true:
+		defer func() { <-ws.Semaphore }()
+
+	default:
+		wsForwarderLog.Debug("Maximum open requests reached, refusing query", "id", req.Id)
+		return ErrBusy
+	}
+
+	out := req.Copy()
+	s := newStream()
+	var session *TSIGSession
+	if out.IsTsig() == nil {
+		reqBytes = nil
+		if ws.Config.TSIGKey != nil {
+			session = &TSIGSession{Key: ws.Config.TSIGKey}
+		}
+	}
+
+	ws.Mutex.Lock()
+	out.Id = ws.uniqueID()
+	reqBytes, err := packQuery(out, reqBytes, session)
+	if err != nil {
+		wsForwarderLog.Error("Pack error", "id", req.Id, "error", err)
+		ws.Mutex.Unlock()
+		return err
+	}
+	ws.Streams[out.Id] = s
+	if err := ws.send(reqBytes); err != nil {
+		delete(ws.Streams, out.Id)
+		ws.Mutex.Unlock()
+		return err
+	}
+	ws.Mutex.Unlock()
+
+	defer func() {
+		ws.Mutex.Lock()
+		// the ID may have been reused already after an overflow
+		if ws.Streams[out.Id] == s {
+			delete(ws.Streams, out.Id)
+		}
+		ws.Mutex.Unlock()
+	}()
+
+	t := newTransfer(req)
+	// the timeout applies to each message of a zone transfer
+	timer := time.NewTimer(ws.Config.Timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.Ready:
+			for {
+				respBytes := ws.pop(s)
+				if respBytes == nil {
+					break
+				}
+				resp := new(dns.Msg)
+				if err := resp.Unpack(respBytes); err != nil {
+					return err
+				}
+				if session != nil {
+					if err := session.Verify(respBytes, resp); err != nil {
+						wsForwarderLog.Warn("Verify error", "id", out.Id, "original_id", req.Id, "error", err)
+						return fmt.Errorf("%w: %v", ErrBadSignature, err)
+					}
+					if respBytes, err = resp.Pack(); err != nil {
+						return err
+					}
+				}
+				binary.BigEndian.PutUint16(respBytes, req.Id)
+				if err := send(respBytes); err != nil {
+					return err
+				}
+				if t.last(resp) {
+					return nil
+				}
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(ws.Config.Timeout)
+			}
+
+		case <-s.Aborted:
+			wsForwarderLog.Debug("Relay aborted", "id", out.Id, "original_id", req.Id, "error", s.Err)
+			return s.Err
+
+		case <-timer.C:
+			wsForwarderLog.Debug("Gave up waiting for response", "id", out.Id, "original_id", req.Id)
+			return ErrTimeout
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// uniqueID returns an ID not used by any open request. The mutex must be
+// held.
+func (ws *WebSocketForwarder) uniqueID() uint16 {
+	for {
+		id := dns.Id()
+		_, waiting := ws.Waiting[id]
+		_, streaming := ws.Streams[id]
+		if !waiting && !streaming {
+			return id
+		}
+	}
+}
+
+// send writes a query to the WebSocket, opening a new connection if there
+// is none or writing fails. The mutex must be held.
+func (ws *WebSocketForwarder) send(reqBytes []byte) error {
+	var err error
+	if ws.Conn != nil {
+		err = ws.write(reqBytes)
+		if err != nil {
+			wsForwarderLog.Debug("WriteMessage error, will reopen and try again", "error", err)
+			ws.Conn.Close()
+			ws.Conn = nil
+		}
+	}
+
+	if ws.Conn == nil {
+		wsForwarderLog.Debug("Opening WebSocket connection", "addr", ws.Addr)
+		err = ws.open()
+		if err != nil {
+			wsForwarderLog.Warn("Open error", "addr", ws.Addr, "error", err)
+		} else {
+			err = ws.write(reqBytes)
+			if err != nil {
+				wsForwarderLog.Warn("WriteMessage error, giving up", "error", err)
+				ws.Conn.Close()
+				ws.Conn = nil
+			}
+		}
+		if err != nil {
+			ws.failBatch(&unreachableError{err})
+			return &unreachableError{err}
+		}
+	}
+	return nil
+}
+
+// write sends a query in the framing of the connection. Batched framings
+// collect queries until the batch is full, or for BatchDelay. The mutex
+// must be held.
+func (ws *WebSocketForwarder) write(reqBytes []byte) error {
+	if !ws.Framing.Batched() {
+		return ws.writeMessage([][]byte{reqBytes})
+	}
+	if !ws.Batcher.Fits(reqBytes) {
+		msgs := ws.Batcher.Take()
+		if err := ws.writeMessage(msgs); err != nil {
+			// kept for open() to send on the next connection
+			for _, msg := range msgs {
+				ws.Batcher.Add(msg)
+			}
+			return err
+		}
+	}
+	ws.Batcher.Add(reqBytes)
+	if ws.Batcher.Len() == 1 {
+		conn, batcher := ws.Conn, ws.Batcher
+		time.AfterFunc(ws.Config.BatchDelay, func() {
+			ws.Mutex.Lock()
+			defer ws.Mutex.Unlock()
+			if batcher.Len() == 0 {
+				// written already, or moved to a new connection by open()
+				return
+			}
+			if ws.Conn == conn {
+				msgs := batcher.Take()
+				err := ws.writeMessage(msgs)
+				if err == nil {
+					return
+				}
+				wsForwarderLog.Debug("WriteMessage error, will reopen and try again", "error", err)
+				ws.Conn.Close()
+				ws.Conn = nil
+				for _, msg := range msgs {
+					batcher.Add(msg)
+				}
+			}
+			// the connection failed with the batch pending
+			if ws.Conn == nil && !ws.Closed {
+				wsForwarderLog.Debug("Opening WebSocket connection", "addr", ws.Addr)
+				if err := ws.open(); err != nil {
+					wsForwarderLog.Warn("Open error", "addr", ws.Addr, "error", err)
+					ws.failBatch(&unreachableError{err})
+				}
+			} else if ws.Closed {
+				ws.failBatch(ErrClosed)
+			}
+		})
+	}
+	return nil
+}
+
+// failBatch ends the queries collected for a connection that failed. The
+// mutex must be held.
+func (ws *WebSocketForwarder) failBatch(err error) {
+	if ws.Batcher == nil {
+		return
+	}
+	for _, reqBytes := range ws.Batcher.Take() {
+		ws.fail(reqBytes, err)
+	}
+}
+
+// fail ends the request of a query that could not be sent, if it is still
+// open. Queries waiting for a single response fail with ErrUnreachable.
+// The mutex must be held.
+func (ws *WebSocketForwarder) fail(reqBytes []byte, err error) {
+	id := binary.BigEndian.Uint16(reqBytes)
+	if respChan, waiting := ws.Waiting[id]; waiting {
+		delete(ws.Waiting, id)
+		close(respChan)
+	}
+	if s, streaming := ws.Streams[id]; streaming {
+		ws.abort(id, s, err)
+	}
+}
+
+// pop takes the oldest queued response of s, or returns nil
+func (ws *WebSocketForwarder) pop(s *stream) []byte {
+	ws.Mutex.Lock()
+	defer ws.Mutex.Unlock()
+	if len(s.Queue) == 0 {
+		return nil
+	}
+	respBytes := s.Queue[0]
+	s.Queue[0] = nil
+	s.Queue = s.Queue[1:]
+	s.Queued -= len(respBytes)
+	return respBytes
+}
+
+// abort ends a relay with err. The mutex must be held.
+func (ws *WebSocketForwarder) abort(id uint16, s *stream, err error) {
+	delete(ws.Streams, id)
+	s.Err = err
+	close(s.Aborted)
+}
+
+// isOpen reports whether the query of reqBytes still waits for responses.
+// The mutex must be held.
+func (ws *WebSocketForwarder) isOpen(reqBytes []byte) bool {
+	id := binary.BigEndian.Uint16(reqBytes)
+	_, waiting := ws.Waiting[id]
+	_, streaming := ws.Streams[id]
+	return waiting || streaming
+}
+
+func (ws *WebSocketForwarder) writeMessage(msgs [][]byte) error {
+	messageType, data, err := ws.Framing.Encode(msgs)
+	if err != nil {
+		return err
+	}
+	ws.Conn.EnableWriteCompression(len(data) >= ws.Config.CompressionMinSize)
+	return ws.Conn.WriteMessage(messageType, data)
+}
+
+func (ws *WebSocketForwarder) Close() {
+	ws.Mutex.Lock()
+	ws.Closed = true
+	if ws.Conn != nil {
+		wsForwarderLog.Debug("Sending close message")
+		message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+		err := ws.Conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(ws.Config.Timeout))
+		if err != nil {
+			wsForwarderLog.Debug("WriteControl error", "error", err)
+		}
+		ws.Conn.Close()
+		ws.Conn = nil
+	}
+	if ws.Transport != nil {
+		ws.Transport.CloseIdleConnections()
+	}
+	ws.Mutex.Unlock()
+	ws.Routines.Wait()
+}
+
+// netDialer returns a dialer resolving host names with the bootstrap server,
+// if there is one
+func (ws *WebSocketForwarder) netDialer() *net.Dialer {
+	if ws.Config.BootstrapServer == "" {
+		return &net.Dialer{}
+	}
+	return &net.Dialer{
+		Resolver: bootstrapResolver(ws.Config.BootstrapServer),
+	}
+}
+
+func (ws *WebSocketForwarder) open() error {
+	dialer := &websocket.Dialer{
+		TLSClientConfig:   ws.TLSConfig,
+		HandshakeTimeout:  ws.Config.Timeout,
+		ReadBufferSize:    ws.Config.WSBufferSize,
+		WriteBufferSize:   ws.Config.WSBufferSize,
+		Subprotocols:      ws.Config.Subprotocols,
+		EnableCompression: ws.Config.Compression,
+	}
+
+	if ws.Config.BootstrapServer != "" {
+		dialer.NetDialContext = ws.netDialer().DialContext
+	}
+
+	// upstreams without HTTP/2 or extended CONNECT get an HTTP/1.1 upgrade
+	var conn *websocket.Conn
+	var err error
+	if ws.Transport != nil {
+		conn, err = extconnect.Dial(ws.Transport, dialer, ws.Addr)
+		if err != nil {
+			wsForwarderLog.Debug("Extended CONNECT error, trying HTTP/1.1", "addr", ws.Addr, "error", err)
+		}
+	}
+	if conn == nil {
+		conn, _, err = dialer.Dial(ws.Addr, nil)
+		if err != nil {
+			return err
+		}
+	}
+	f := framing.Lookup(conn.Subprotocol())
+	if f == nil {
+		conn.Close()
+		return fmt.Errorf("unsupported subprotocol %q", conn.Subprotocol())
+	}
+	wsForwarderLog.Debug("Opened WebSocket connection", "addr", ws.Addr, "subprotocol", conn.Subprotocol())
+	if err := conn.SetCompressionLevel(ws.Config.CompressionLevel); err != nil {
+		conn.Close()
+		return err
+	}
+	// queries batched for the previous connection are sent on this one
+	var pending [][]byte
+	if ws.Batcher != nil {
+		pending = ws.Batcher.Take()
+	}
+	ws.Conn = conn
+	ws.Framing = f
+	ws.Batcher = &framing.Batcher{MaxSize: ws.Config.BatchSize}
+
+	ws.Routines.Add(1)
+	go func() {
+		wsForwarderLog.Debug("Starting read loop")
+		defer func() {
+			wsForwarderLog.Debug("Exiting read loop")
+			conn.Close()
+			ws.Routines.Done()
+		}()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				wsForwarderLog.Debug("ReadMessage error", "error", err)
+				break
+			}
+			msgs, err := f.Decode(messageType, data)
+			if err != nil {
+				wsForwarderLog.Warn("Decode error", "error", err)
+				continue
+			}
+			for _, respBytes := range msgs {
+				ws.dispatch(respBytes)
+			}
+		}
+	}()
+
+	for _, reqBytes := range pending {
+		if !ws.isOpen(reqBytes) {
+			continue
+		}
+		if err := ws.write(reqBytes); err != nil {
+			ws.fail(reqBytes, &unreachableError{err})
+		}
+	}
+	return nil
+}
+
+// dispatch passes a response to the query waiting for it. It runs in the read
+// loop shared by all queries of the connection, so it must never block.
+func (ws *WebSocketForwarder) dispatch(respBytes []byte) {
+	if len(respBytes) < 12 {
+		wsForwarderLog.Warn("Unpack error (invalid message)", "error", dns.ErrShortRead)
+		return
+	}
+	id := binary.BigEndian.Uint16(respBytes)
+	ws.Mutex.Lock()
+	if s, streaming := ws.Streams[id]; streaming {
+		if s.Queued+len(respBytes) > ws.Config.RelayBufferSize {
+			wsForwarderLog.Warn("Client too slow, aborting relay", "id", id, "queued_bytes", s.Queued)
+			ws.abort(id, s, ErrBusy)
+		} else {
+			s.Queue = append(s.Queue, respBytes)
+			s.Queued += len(respBytes)
+			select {
+			case s.Ready <- true:
+			default:
+			}
+		}
+		ws.Mutex.Unlock()
+		return
+	}
+	respChan, waiting := ws.Waiting[id]
+	if waiting {
+		delete(ws.Waiting, id)
+	}
+	ws.Mutex.Unlock()
+	switch {
+	case waiting:
+		respChan <- respBytes
+	default:
+		wsForwarderLog.Debug("Received response for stale query", "id", id)
+	}
+}
@@ -0,0 +1,166 @@
+// Package framing defines how DNS messages are carried in WebSocket
+// messages. Each framing is named by the subprotocol negotiated for it with
+// the Sec-WebSocket-Protocol header, so that new framings can be added
+// without breaking clients of the old ones.
+package framing
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+)
+
+const (
+	// V1 is one DNS message per binary WebSocket message, the framing used
+	// before subprotocols were negotiated
+	V1 = "dns.v1"
+	// Batch is one or more DNS messages per binary WebSocket message, each
+	// preceded by its length as a two byte big endian number like over TCP
+	Batch = "dns.batch.v1"
+)
+
+var ErrInvalid = errors.New("invalid WebSocket message")
+
+type Framing interface {
+	// Encode returns the WebSocket message type and data carrying DNS
+	// messages in wire format
+	Encode(msgs [][]byte) (messageType int, data []byte, err error)
+	// Decode returns the DNS messages in wire format carried by a WebSocket
+	// message
+	Decode(messageType int, data []byte) ([][]byte, error)
+	// Batched reports whether a WebSocket message can carry more than one
+	// DNS message, to be collected with a Batcher
+	Batched() bool
+}
+
+var framings = map[string]Framing{
+	V1:    v1{},
+	Batch: batch{},
+}
+
+// Supported lists the subprotocols of all framings, in order of preference
+var Supported = []string{Batch, V1}
+
+// Default lists the subprotocols used unless configured otherwise
+var Default = []string{V1}
+
+// Lookup returns the framing of a negotiated subprotocol, or nil if there is
+// none. Without a subprotocol the framing is V1.
+func Lookup(subprotocol string) Framing {
+	if subprotocol == "" {
+		subprotocol = V1
+	}
+	return framings[subprotocol]
+}
+
+// ParseList parses a comma separated list of subprotocols
+func ParseList(s string) ([]string, error) {
+	list := []string{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if framings[name] == nil {
+			return nil, fmt.Errorf("unknown subprotocol %q", name)
+		}
+		list = append(list, name)
+	}
+	return list, nil
+}
+
+type v1 struct{}
+
+func (v1) Encode(msgs [][]byte) (int, []byte, error) {
+	if len(msgs) != 1 {
+		return 0, nil, fmt.Errorf("%s carries one message per WebSocket message, not %d", V1, len(msgs))
+	}
+	return websocket.BinaryMessage, msgs[0], nil
+}
+
+func (v1) Decode(messageType int, data []byte) ([][]byte, error) {
+	if messageType != websocket.BinaryMessage {
+		return nil, ErrInvalid
+	}
+	return [][]byte{data}, nil
+}
+
+func (v1) Batched() bool {
+	return false
+}
+
+type batch struct{}
+
+func (batch) Encode(msgs [][]byte) (int, []byte, error) {
+	size := 0
+	for _, msg := range msgs {
+		if len(msg) > 0xFFFF {
+			return 0, nil, dns.ErrBuf
+		}
+		size += 2 + len(msg)
+	}
+	data := make([]byte, 0, size)
+	for _, msg := range msgs {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(msg)))
+		data = append(data, msg...)
+	}
+	return websocket.BinaryMessage, data, nil
+}
+
+func (batch) Decode(messageType int, data []byte) ([][]byte, error) {
+	if messageType != websocket.BinaryMessage || len(data) == 0 {
+		return nil, ErrInvalid
+	}
+	var msgs [][]byte
+	for len(data) != 0 {
+		if len(data) < 2 {
+			return nil, ErrInvalid
+		}
+		size := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+size {
+			return nil, ErrInvalid
+		}
+		msgs = append(msgs, data[2:2+size])
+		data = data[2+size:]
+	}
+	return msgs, nil
+}
+
+func (batch) Batched() bool {
+	return true
+}
+
+// Batcher collects DNS messages for a batched framing, up to MaxSize bytes
+// per WebSocket message unless a single message is larger. It is not safe
+// for concurrent use.
+type Batcher struct {
+	MaxSize int
+	Msgs    [][]byte
+	Size    int
+}
+
+// Fits reports whether msg can be added without exceeding MaxSize
+func (b *Batcher) Fits(msg []byte) bool {
+	return len(b.Msgs) == 0 || b.Size+2+len(msg) <= b.MaxSize
+}
+
+func (b *Batcher) Add(msg []byte) {
+	b.Msgs = append(b.Msgs, msg)
+	b.Size += 2 + len(msg)
+}
+
+func (b *Batcher) Len() int {
+	return len(b.Msgs)
+}
+
+// Take returns the collected messages and empties the batch
+func (b *Batcher) Take() [][]byte {
+	msgs := b.Msgs
+	b.Msgs = nil
+	b.Size = 0
+	return msgs
+}
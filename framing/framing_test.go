@@ -0,0 +1,150 @@
+package framing
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+)
+
+func packed(t *testing.T, name string, qtype uint16) []byte {
+	t.Helper()
+	b, err := new(dns.Msg).SetQuestion(name, qtype).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	a := packed(t, "a.example.org.", dns.TypeA)
+	aaaa := packed(t, "aaaa.example.org.", dns.TypeAAAA)
+	large := make([]byte, 0xFFFF)
+	large[0] = 1
+
+	tests := []struct {
+		framing string
+		msgs    [][]byte
+	}{
+		{V1, [][]byte{a}},
+		{Batch, [][]byte{a}},
+		{Batch, [][]byte{a, aaaa, a}},
+		{Batch, [][]byte{large, a}},
+		{Batch, [][]byte{a, {}, aaaa}},
+	}
+	for _, tt := range tests {
+		f := Lookup(tt.framing)
+		messageType, data, err := f.Encode(tt.msgs)
+		if err != nil {
+			t.Errorf("%s: Encode error: %v", tt.framing, err)
+			continue
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Errorf("%s: message type %d, want binary", tt.framing, messageType)
+		}
+		msgs, err := f.Decode(messageType, data)
+		if err != nil {
+			t.Errorf("%s: Decode error: %v", tt.framing, err)
+			continue
+		}
+		if len(msgs) != len(tt.msgs) {
+			t.Errorf("%s: decoded %d messages, want %d", tt.framing, len(msgs), len(tt.msgs))
+			continue
+		}
+		for i := range msgs {
+			if !bytes.Equal(msgs[i], tt.msgs[i]) {
+				t.Errorf("%s: message %d changed", tt.framing, i)
+			}
+		}
+	}
+}
+
+func TestBatchEncoding(t *testing.T) {
+	_, data, err := Lookup(Batch).Encode([][]byte{{1, 2, 3}, {4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 3, 1, 2, 3, 0, 1, 4}; !bytes.Equal(data, want) {
+		t.Errorf("Encode = %v, want %v", data, want)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	a := []byte{1, 2, 3}
+	if _, _, err := Lookup(V1).Encode([][]byte{a, a}); err == nil {
+		t.Errorf("%s: no error encoding two messages", V1)
+	}
+	if _, _, err := Lookup(Batch).Encode([][]byte{a, make([]byte, 0x10000)}); err == nil {
+		t.Errorf("%s: no error encoding a message over 65535 bytes", Batch)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		framing     string
+		messageType int
+		data        []byte
+	}{
+		{"v1 text", V1, websocket.TextMessage, []byte("{}")},
+		{"batch text", Batch, websocket.TextMessage, []byte{0, 1, 1}},
+		{"batch empty", Batch, websocket.BinaryMessage, nil},
+		{"batch short length", Batch, websocket.BinaryMessage, []byte{0, 1, 1, 0}},
+		{"batch short message", Batch, websocket.BinaryMessage, []byte{0, 3, 1, 2}},
+	}
+	for _, tt := range tests {
+		if msgs, err := Lookup(tt.framing).Decode(tt.messageType, tt.data); err != ErrInvalid {
+			t.Errorf("%s: Decode = %v, %v, want %v", tt.name, msgs, err, ErrInvalid)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if Lookup("") != Lookup(V1) || Lookup(V1) == nil {
+		t.Errorf("no subprotocol is not %s", V1)
+	}
+	if !Lookup(Batch).Batched() || Lookup(V1).Batched() {
+		t.Error("only the batch framing should be batched")
+	}
+	if Lookup("dns.v2") != nil {
+		t.Error("unknown subprotocol found")
+	}
+}
+
+func TestParseList(t *testing.T) {
+	list, err := ParseList(" dns.batch.v1, ,dns.v1 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0] != Batch || list[1] != V1 {
+		t.Errorf("ParseList = %q", list)
+	}
+	if list, err := ParseList("dns.v1,dns.v2"); err == nil {
+		t.Errorf("ParseList = %q, want error for unknown subprotocol", list)
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	b := &Batcher{MaxSize: 10}
+	msg := []byte{1, 2, 3}
+	for i := 0; i < 2; i++ {
+		if !b.Fits(msg) {
+			t.Fatalf("message %d does not fit", i+1)
+		}
+		b.Add(msg)
+	}
+	// 2 × (2+3) bytes, a third one would exceed 10
+	if b.Fits(msg) {
+		t.Error("third message fits")
+	}
+	msgs := b.Take()
+	if len(msgs) != 2 || b.Len() != 0 || b.Size != 0 {
+		t.Errorf("Take returned %d messages, left %d of %d bytes", len(msgs), b.Len(), b.Size)
+	}
+
+	// a single message larger than MaxSize is still accepted
+	if !b.Fits(make([]byte, 100)) {
+		t.Error("large message does not fit an empty batch")
+	}
+}
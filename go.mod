@@ -1,15 +1,21 @@
 module github.com/dnschecktool/dow-proxy
 
-go 1.19
+go 1.24
 
 require (
+	github.com/dnstap/golang-dnstap v0.4.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/miekg/dns v1.1.50
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	google.golang.org/protobuf v1.23.0
 )
 
 require (
-	golang.org/x/mod v0.7.0 // indirect
-	golang.org/x/net v0.5.0 // indirect
-	golang.org/x/sys v0.4.0 // indirect
-	golang.org/x/tools v0.5.0 // indirect
+	github.com/farsightsec/golang-framestream v0.3.0 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
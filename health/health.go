@@ -0,0 +1,309 @@
+// Package health tracks listener and upstream state and serves the
+// /healthz, /readyz and /metrics endpoints.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/miekg/dns"
+)
+
+var healthLog = logging.New("Health")
+
+type UpstreamStatus struct {
+	Address     string     `json:"address"`
+	Healthy     bool       `json:"healthy"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+type HealthStatus struct {
+	Ready          bool              `json:"ready"`
+	Listeners      map[string]bool   `json:"listeners"`
+	Upstreams      []*UpstreamStatus `json:"upstreams"`
+	OpenWebSockets *int              `json:"open_websockets,omitempty"`
+}
+
+// UpstreamCounters count canary queries and health changes since the start
+type UpstreamCounters struct {
+	Successes       uint64
+	Failures        uint64
+	BecameHealthy   uint64
+	BecameUnhealthy uint64
+}
+
+// UpstreamCheck holds the health state of one forwarder. The state only
+// changes after Rise consecutive successful or Fall consecutive failed
+// canary queries.
+type UpstreamCheck struct {
+	Forwarder forwarder.Forwarder
+	Rise      int
+	Fall      int
+	Mutex     sync.Mutex
+	Status    UpstreamStatus
+	Counters  UpstreamCounters
+	Successes int
+	Failures  int
+}
+
+func NewUpstreamCheck(f forwarder.Forwarder, rise int, fall int) *UpstreamCheck {
+	return &UpstreamCheck{
+		Forwarder: f,
+		Rise:      rise,
+		Fall:      fall,
+		// assume healthy until proven otherwise so queries are not held back
+		Status: UpstreamStatus{Address: f.Address(), Healthy: true},
+	}
+}
+
+func (c *UpstreamCheck) Healthy() bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.Status.Healthy
+}
+
+// probe sends the canary query through the forwarder, giving up after
+// timeout. For WebSocket upstreams this also keeps the connection open
+// between client queries.
+func (c *UpstreamCheck) probe(canary dns.Question, timeout time.Duration) {
+	req := new(dns.Msg)
+	req.SetQuestion(canary.Name, canary.Qtype)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	resp, err := c.Forwarder.ForwardContext(ctx, req)
+	cancel()
+
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if err == nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused {
+		now := time.Now()
+		c.Status.LastSuccess = &now
+		c.Status.LastError = ""
+		c.Failures = 0
+		c.Successes++
+		c.Counters.Successes++
+		if !c.Status.Healthy && c.Successes >= c.Rise {
+			c.Status.Healthy = true
+			c.Counters.BecameHealthy++
+			healthLog.Info("Upstream is healthy", "upstream", c.Status.Address)
+		}
+		return
+	}
+
+	if err != nil {
+		c.Status.LastError = err.Error()
+	} else {
+		c.Status.LastError = dns.RcodeToString[resp.Rcode]
+	}
+	c.Successes = 0
+	c.Failures++
+	c.Counters.Failures++
+	healthLog.Debug("Canary query failed", "upstream", c.Status.Address, "error", c.Status.LastError)
+	if c.Status.Healthy && c.Failures >= c.Fall {
+		c.Status.Healthy = false
+		c.Counters.BecameUnhealthy++
+		healthLog.Warn("Upstream is unhealthy", "upstream", c.Status.Address, "error", c.Status.LastError)
+	}
+}
+
+// Monitor tracks listener and upstream state for the /healthz and /readyz
+// endpoints. Every upstream is probed with the canary query every Interval,
+// waiting at most Timeout for the answer.
+type Monitor struct {
+	Interval   time.Duration
+	Timeout    time.Duration
+	Canary     dns.Question
+	Upstreams  []*UpstreamCheck
+	Mutex      sync.Mutex
+	Listeners  map[string]bool
+	WebSockets func() int
+	Done       chan bool
+}
+
+func New(interval time.Duration, timeout time.Duration, canary dns.Question, upstreams []*UpstreamCheck) *Monitor {
+	return &Monitor{
+		Interval:  interval,
+		Timeout:   timeout,
+		Canary:    canary,
+		Upstreams: upstreams,
+		Listeners: make(map[string]bool),
+		Done:      make(chan bool),
+	}
+}
+
+// ParseCanary parses a canary query given as "name type", e.g. ". NS"
+func ParseCanary(s string) (dns.Question, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return dns.Question{}, fmt.Errorf("expected \"name type\"")
+	}
+	if _, ok := dns.IsDomainName(fields[0]); !ok {
+		return dns.Question{}, fmt.Errorf("invalid name %q", fields[0])
+	}
+	qtype, found := dns.StringToType[strings.ToUpper(fields[1])]
+	if !found {
+		return dns.Question{}, fmt.Errorf("unknown type %q", fields[1])
+	}
+	return dns.Question{Name: dns.Fqdn(fields[0]), Qtype: qtype, Qclass: dns.ClassINET}, nil
+}
+
+// AddListener registers a listener that must be bound before the process
+// reports ready
+func (h *Monitor) AddListener(name string) {
+	h.Mutex.Lock()
+	h.Listeners[name] = false
+	h.Mutex.Unlock()
+}
+
+func (h *Monitor) SetListenerBound(name string) {
+	h.Mutex.Lock()
+	h.Listeners[name] = true
+	h.Mutex.Unlock()
+}
+
+// Run probes the upstreams until Close is called
+func (h *Monitor) Run() {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		var probes sync.WaitGroup
+		for _, c := range h.Upstreams {
+			probes.Add(1)
+			go func(c *UpstreamCheck) {
+				defer probes.Done()
+				c.probe(h.Canary, h.Timeout)
+			}(c)
+		}
+		probes.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-h.Done:
+			return
+		}
+	}
+}
+
+func (h *Monitor) Close() {
+	close(h.Done)
+}
+
+// Status reports ready once all listeners are bound and at least one
+// upstream is healthy and has answered a canary query recently, within the
+// Fall probes that would mark it unhealthy
+func (h *Monitor) Status() *HealthStatus {
+	h.Mutex.Lock()
+	listenersReady := true
+	listeners := make(map[string]bool, len(h.Listeners))
+	for name, bound := range h.Listeners {
+		listeners[name] = bound
+		listenersReady = listenersReady && bound
+	}
+	h.Mutex.Unlock()
+
+	var upstreamReady bool
+	upstreams := make([]*UpstreamStatus, 0, len(h.Upstreams))
+	for _, c := range h.Upstreams {
+		c.Mutex.Lock()
+		status := c.Status
+		window := time.Duration(c.Fall)*h.Interval + h.Timeout
+		c.Mutex.Unlock()
+		if status.Healthy && status.LastSuccess != nil && time.Since(*status.LastSuccess) <= window {
+			upstreamReady = true
+		}
+		upstreams = append(upstreams, &status)
+	}
+
+	status := &HealthStatus{
+		Ready:     listenersReady && upstreamReady,
+		Listeners: listeners,
+		Upstreams: upstreams,
+	}
+	if h.WebSockets != nil {
+		open := h.WebSockets()
+		status.OpenWebSockets = &open
+	}
+	return status
+}
+
+func (h *Monitor) ServeHealthz(hrw http.ResponseWriter, hr *http.Request) {
+	hrw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	hrw.Write([]byte("ok\n"))
+}
+
+func (h *Monitor) ServeReadyz(hrw http.ResponseWriter, hr *http.Request) {
+	status := h.Status()
+	hrw.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		hrw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(hrw).Encode(status)
+}
+
+// metricLabel escapes a label value of the Prometheus text format
+var metricLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeMetrics writes the upstream health state and canary query counters
+// in the Prometheus text format
+func (h *Monitor) ServeMetrics(hrw http.ResponseWriter, hr *http.Request) {
+	type upstream struct {
+		Label    string
+		Status   UpstreamStatus
+		Counters UpstreamCounters
+	}
+	upstreams := make([]upstream, 0, len(h.Upstreams))
+	for _, c := range h.Upstreams {
+		c.Mutex.Lock()
+		upstreams = append(upstreams, upstream{
+			Label:    `upstream="` + metricLabel.Replace(c.Status.Address) + `"`,
+			Status:   c.Status,
+			Counters: c.Counters,
+		})
+		c.Mutex.Unlock()
+	}
+
+	var b strings.Builder
+	b.WriteString("# HELP dow_proxy_upstream_healthy Whether the upstream is healthy and receives queries.\n")
+	b.WriteString("# TYPE dow_proxy_upstream_healthy gauge\n")
+	for _, u := range upstreams {
+		healthy := 0
+		if u.Status.Healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(&b, "dow_proxy_upstream_healthy{%s} %d\n", u.Label, healthy)
+	}
+	b.WriteString("# HELP dow_proxy_upstream_probes_total Canary queries sent to the upstream, by result.\n")
+	b.WriteString("# TYPE dow_proxy_upstream_probes_total counter\n")
+	for _, u := range upstreams {
+		fmt.Fprintf(&b, "dow_proxy_upstream_probes_total{%s,result=\"success\"} %d\n", u.Label, u.Counters.Successes)
+		fmt.Fprintf(&b, "dow_proxy_upstream_probes_total{%s,result=\"failure\"} %d\n", u.Label, u.Counters.Failures)
+	}
+	b.WriteString("# HELP dow_proxy_upstream_transitions_total Changes of the upstream health state, by new state.\n")
+	b.WriteString("# TYPE dow_proxy_upstream_transitions_total counter\n")
+	for _, u := range upstreams {
+		fmt.Fprintf(&b, "dow_proxy_upstream_transitions_total{%s,state=\"healthy\"} %d\n", u.Label, u.Counters.BecameHealthy)
+		fmt.Fprintf(&b, "dow_proxy_upstream_transitions_total{%s,state=\"unhealthy\"} %d\n", u.Label, u.Counters.BecameUnhealthy)
+	}
+	b.WriteString("# HELP dow_proxy_upstream_last_success_timestamp_seconds Time of the last successful canary query.\n")
+	b.WriteString("# TYPE dow_proxy_upstream_last_success_timestamp_seconds gauge\n")
+	for _, u := range upstreams {
+		if u.Status.LastSuccess != nil {
+			fmt.Fprintf(&b, "dow_proxy_upstream_last_success_timestamp_seconds{%s} %.3f\n", u.Label, float64(u.Status.LastSuccess.UnixMilli())/1000)
+		}
+	}
+	if h.WebSockets != nil {
+		b.WriteString("# HELP dow_proxy_open_websockets WebSocket connections open in server mode.\n")
+		b.WriteString("# TYPE dow_proxy_open_websockets gauge\n")
+		fmt.Fprintf(&b, "dow_proxy_open_websockets %d\n", h.WebSockets())
+	}
+
+	hrw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	hrw.Write([]byte(b.String()))
+}
@@ -0,0 +1,102 @@
+package health
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/miekg/dns"
+)
+
+// fakeForwarder answers canary queries while Up is set
+type fakeForwarder struct {
+	Up bool
+}
+
+func (f *fakeForwarder) Address() string {
+	return "192.0.2.53:53"
+}
+
+func (f *fakeForwarder) ForwardContext(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if !f.Up {
+		return nil, forwarder.ErrTimeout
+	}
+	return new(dns.Msg).SetReply(req), nil
+}
+
+func (f *fakeForwarder) Close() {}
+
+func TestUpstreamCheck(t *testing.T) {
+	f := &fakeForwarder{Up: true}
+	c := NewUpstreamCheck(f, 2, 3)
+	canary := dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+
+	steps := []struct {
+		up      bool
+		healthy bool
+	}{
+		{true, true},
+		{false, true},
+		{false, true},
+		{false, false},
+		{true, false},
+		{false, false},
+		{true, false},
+		{true, true},
+	}
+	for i, step := range steps {
+		f.Up = step.up
+		c.probe(canary, time.Second)
+		if c.Healthy() != step.healthy {
+			t.Errorf("probe %d: healthy %v, want %v", i+1, c.Healthy(), step.healthy)
+		}
+	}
+	want := UpstreamCounters{Successes: 4, Failures: 4, BecameHealthy: 1, BecameUnhealthy: 1}
+	if c.Counters != want {
+		t.Errorf("counters %+v, want %+v", c.Counters, want)
+	}
+
+	m := New(time.Second, time.Second, canary, []*UpstreamCheck{c})
+	rec := httptest.NewRecorder()
+	m.ServeMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`dow_proxy_upstream_healthy{upstream="192.0.2.53:53"} 1`,
+		`dow_proxy_upstream_probes_total{upstream="192.0.2.53:53",result="failure"} 4`,
+		`dow_proxy_upstream_transitions_total{upstream="192.0.2.53:53",state="unhealthy"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, rec.Body)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	f := &fakeForwarder{Up: true}
+	c := NewUpstreamCheck(f, 1, 2)
+	canary := dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+	m := New(time.Second, time.Second, canary, []*UpstreamCheck{c})
+	m.AddListener("udp")
+
+	if m.Status().Ready {
+		t.Error("ready before the listener is bound and the canary answered")
+	}
+	m.SetListenerBound("udp")
+	if m.Status().Ready {
+		t.Error("ready before the canary answered")
+	}
+	c.probe(canary, time.Second)
+	if !m.Status().Ready {
+		t.Error("not ready after the canary answered")
+	}
+
+	// still healthy, but the last answer is older than Fall intervals and
+	// the timeout
+	old := time.Now().Add(-4 * time.Second)
+	c.Status.LastSuccess = &old
+	if m.Status().Ready {
+		t.Error("ready with an old canary answer")
+	}
+}
@@ -0,0 +1,368 @@
+// Package extconnect bootstraps WebSockets with the extended CONNECT method
+// of HTTP/2 (RFC 8441), so that many of them share one connection. The
+// WebSocket library only knows the HTTP/1.1 upgrade handshake, so the
+// HTTP/2 streams are wrapped in connections that translate it. Deadlines
+// set on the connections of clients have no effect.
+package extconnect
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+)
+
+// Headers of the handshake passed between the HTTP/2 stream and the
+// translated HTTP/1.1 upgrade
+var handshakeHeaders = []string{"Sec-Websocket-Protocol", "Sec-Websocket-Extensions"}
+
+var errHandshake = errors.New("incomplete handshake")
+
+// IsRequest reports whether r opens a WebSocket with extended CONNECT
+func IsRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && r.Method == http.MethodConnect && strings.EqualFold(r.Header.Get(":protocol"), "websocket")
+}
+
+// Upgrade accepts a WebSocket opened with extended CONNECT, as u.Upgrade
+// does for HTTP/1.1 upgrades
+func Upgrade(u *websocket.Upgrader, w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	r = r.Clone(r.Context())
+	r.Method = http.MethodGet
+	r.Header.Del(":protocol")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-Websocket-Key", newKey())
+	return u.Upgrade(&hijacker{ResponseWriter: w, r: r}, r, nil)
+}
+
+type hijacker struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (h *hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c := &serverConn{
+		w:          h.ResponseWriter,
+		rc:         http.NewResponseController(h.ResponseWriter),
+		body:       h.r.Body,
+		remoteAddr: addr(h.r.RemoteAddr),
+	}
+	return c, bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c)), nil
+}
+
+// serverConn is the stream of a WebSocket accepted with extended CONNECT.
+// The HTTP/1.1 handshake response written first is answered with the
+// HTTP/2 response.
+type serverConn struct {
+	w          http.ResponseWriter
+	rc         *http.ResponseController
+	body       io.ReadCloser
+	remoteAddr net.Addr
+	responded  bool
+}
+
+func (c *serverConn) Read(p []byte) (int, error) {
+	return c.body.Read(p)
+}
+
+func (c *serverConn) Write(p []byte) (int, error) {
+	if c.responded {
+		n, err := c.w.Write(p)
+		if err != nil {
+			return n, err
+		}
+		return n, c.rc.Flush()
+	}
+	br := bufio.NewReader(bytes.NewReader(p))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return 0, err
+	}
+	if br.Buffered() != 0 {
+		return 0, errHandshake
+	}
+	for _, name := range handshakeHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			c.w.Header().Set(name, v)
+		}
+	}
+	c.w.WriteHeader(http.StatusOK)
+	c.responded = true
+	return len(p), c.rc.Flush()
+}
+
+func (c *serverConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *serverConn) LocalAddr() net.Addr {
+	return addr("")
+}
+
+func (c *serverConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *serverConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *serverConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *serverConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// Dial opens a WebSocket to a ws:// or wss:// URL with extended CONNECT,
+// sent with t, which should only speak HTTP/2. It fails if the server does
+// not support extended CONNECT.
+func Dial(t http.RoundTripper, d *websocket.Dialer, wsURL string) (*websocket.Conn, error) {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	// the stream is reset when the context of its request is cancelled,
+	// so the handshake timeout only applies until the response
+	ctx, cancel := context.WithCancel(context.Background())
+	if d.HandshakeTimeout > 0 {
+		timer := time.AfterFunc(d.HandshakeTimeout, cancel)
+		defer timer.Stop()
+	}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, u.String(), pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set("Sec-Websocket-Version", "13")
+	if len(d.Subprotocols) != 0 {
+		req.Header.Set("Sec-Websocket-Protocol", strings.Join(d.Subprotocols, ", "))
+	}
+	if d.EnableCompression {
+		req.Header.Set("Sec-Websocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	}
+	resp, err := t.RoundTrip(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("%w: %s", websocket.ErrBadHandshake, resp.Status)
+	}
+
+	c := &clientConn{resp: resp, body: pw, cancel: cancel}
+	tunnel := *d
+	tunnel.NetDial = nil
+	tunnel.NetDialTLSContext = nil
+	tunnel.Proxy = nil
+	tunnel.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return c, nil
+	}
+	u.Scheme = "ws"
+	conn, _, err := tunnel.Dial(u.String(), nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// clientConn is the stream of a WebSocket opened with extended CONNECT. The
+// HTTP/1.1 handshake request written first is answered with a response
+// made from the HTTP/2 response.
+type clientConn struct {
+	resp   *http.Response
+	body   *io.PipeWriter
+	cancel context.CancelFunc
+	// the translated handshake response, until read
+	handshake []byte
+	requested bool
+}
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	if len(c.handshake) != 0 {
+		n := copy(p, c.handshake)
+		c.handshake = c.handshake[n:]
+		return n, nil
+	}
+	return c.resp.Body.Read(p)
+}
+
+func (c *clientConn) Write(p []byte) (int, error) {
+	if c.requested {
+		return c.body.Write(p)
+	}
+	br := bufio.NewReader(bytes.NewReader(p))
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return 0, err
+	}
+	if br.Buffered() != 0 {
+		return 0, errHandshake
+	}
+	var b bytes.Buffer
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(&b, "Sec-WebSocket-Accept: %s\r\n", acceptKey(req.Header.Get("Sec-Websocket-Key")))
+	for _, name := range handshakeHeaders {
+		if v := c.resp.Header.Get(name); v != "" {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, v)
+		}
+	}
+	b.WriteString("\r\n")
+	c.handshake = b.Bytes()
+	c.requested = true
+	return len(p), nil
+}
+
+func (c *clientConn) Close() error {
+	c.body.Close()
+	err := c.resp.Body.Close()
+	c.cancel()
+	return err
+}
+
+func (c *clientConn) LocalAddr() net.Addr {
+	return addr("")
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	return addr(c.resp.Request.URL.Host)
+}
+
+func (c *clientConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *clientConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *clientConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// addr is the address of a stream's connection, as known to net/http
+type addr string
+
+func (a addr) Network() string {
+	return "tcp"
+}
+
+func (a addr) String() string {
+	return string(a)
+}
+
+func newKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// ServerDisabled reports whether GODEBUG turns extended CONNECT off on
+// purpose
+func ServerDisabled() bool {
+	return strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=0")
+}
+
+// ServerAvailable reports whether the HTTP/2 server of net/http accepts
+// extended CONNECT, by reading the settings it sends on a new connection
+func ServerAvailable() bool {
+	client, server := net.Pipe()
+	defer client.Close()
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{
+		Handler:   http.NotFoundHandler(),
+		Protocols: protocols,
+	}
+	go srv.Serve(newPipeListener(server))
+	defer srv.Close()
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	go client.Write([]byte(http2.ClientPreface))
+	frame, err := http2.NewFramer(client, client).ReadFrame()
+	if err != nil {
+		return false
+	}
+	settings, ok := frame.(*http2.SettingsFrame)
+	if !ok {
+		return false
+	}
+	v, ok := settings.Value(http2.SettingEnableConnectProtocol)
+	return ok && v == 1
+}
+
+// pipeListener accepts a single connection
+type pipeListener struct {
+	Conns  chan net.Conn
+	Done   chan bool
+	Closed sync.Once
+}
+
+func newPipeListener(conn net.Conn) *pipeListener {
+	l := &pipeListener{Conns: make(chan net.Conn, 1), Done: make(chan bool)}
+	l.Conns <- conn
+	return l
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.Conns:
+		return conn, nil
+	case <-l.Done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.Closed.Do(func() { close(l.Done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,27 @@
+package netutil
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// HostPort normalizes s to "host:port", adding defaultPort if s has no port.
+// It returns "" if s is not acceptable.
+func HostPort(s string, defaultPort int, requireHost bool, ipOnly bool) string {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host = s
+		port = strconv.Itoa(defaultPort)
+	}
+	if requireHost && host == "" {
+		return ""
+	}
+	s = net.JoinHostPort(host, port)
+	if ipOnly && host != "" {
+		if _, err := netip.ParseAddrPort(s); err != nil {
+			return ""
+		}
+	}
+	return s
+}
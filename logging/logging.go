@@ -0,0 +1,166 @@
+// Package logging names the components of the proxy in log/slog records and
+// applies per-component level overrides. Loggers write to slog.Default() as
+// it is when they log, so programs importing the proxy packages choose the
+// handler with slog.SetDefault.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ComponentKey is the attribute naming the component of a record
+const ComponentKey = "component"
+
+// Logger writes records of one component, with optional attributes, to the
+// default slog logger
+type Logger struct {
+	Component string
+	Attrs     []any
+	cache     atomic.Pointer[derived]
+}
+
+// derived is the logger of a Logger for the default logger it came from
+type derived struct {
+	base   *slog.Logger
+	logger *slog.Logger
+}
+
+func New(component string) *Logger {
+	return &Logger{Component: component}
+}
+
+// With returns a logger that adds the given key-value pairs to every message
+func (l *Logger) With(kv ...any) *Logger {
+	attrs := make([]any, 0, len(l.Attrs)+len(kv))
+	attrs = append(attrs, l.Attrs...)
+	attrs = append(attrs, kv...)
+	return &Logger{Component: l.Component, Attrs: attrs}
+}
+
+// Slog returns the slog logger l writes to
+func (l *Logger) Slog() *slog.Logger {
+	base := slog.Default()
+	if d := l.cache.Load(); d != nil && d.base == base {
+		return d.logger
+	}
+	logger := base
+	if l.Component != "" {
+		logger = logger.With(ComponentKey, l.Component)
+	}
+	if len(l.Attrs) != 0 {
+		logger = logger.With(l.Attrs...)
+	}
+	l.cache.Store(&derived{base: base, logger: logger})
+	return logger
+}
+
+func (l *Logger) Enabled(level slog.Level) bool {
+	return l.Slog().Enabled(context.Background(), level)
+}
+
+func (l *Logger) Debug(msg string, kv ...any) {
+	l.Slog().Debug(msg, kv...)
+}
+
+func (l *Logger) Info(msg string, kv ...any) {
+	l.Slog().Info(msg, kv...)
+}
+
+func (l *Logger) Warn(msg string, kv ...any) {
+	l.Slog().Warn(msg, kv...)
+}
+
+func (l *Logger) Error(msg string, kv ...any) {
+	l.Slog().Error(msg, kv...)
+}
+
+// Fatal logs at error level regardless of the configured level and exits
+func (l *Logger) Fatal(msg string, kv ...any) {
+	r := slog.NewRecord(time.Now(), slog.LevelError, msg, 0)
+	r.Add(kv...)
+	l.Slog().Handler().Handle(context.Background(), r)
+	os.Exit(1)
+}
+
+// LevelHandler passes on the records of components at or above their level
+// in ComponentLevels, and of other components at or above Level. The
+// wrapped Handler should accept all levels.
+type LevelHandler struct {
+	Handler         slog.Handler
+	Level           slog.Leveler
+	ComponentLevels map[string]slog.Level
+	component       string
+}
+
+func NewLevelHandler(h slog.Handler, level slog.Leveler, componentLevels map[string]slog.Level) *LevelHandler {
+	return &LevelHandler{Handler: h, Level: level, ComponentLevels: componentLevels}
+}
+
+func (h *LevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if componentLevel, found := h.ComponentLevels[h.component]; found {
+		return level >= componentLevel
+	}
+	return level >= h.Level.Level()
+}
+
+func (h *LevelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *LevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	for _, attr := range attrs {
+		if attr.Key == ComponentKey {
+			c.component = attr.Value.String()
+		}
+	}
+	c.Handler = h.Handler.WithAttrs(attrs)
+	return &c
+}
+
+func (h *LevelHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.Handler = h.Handler.WithGroup(name)
+	return &c
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (slog.Level, bool) {
+	var level slog.Level
+	switch strings.ToLower(s) {
+	case "debug":
+		level = slog.LevelDebug
+	case "info":
+		level = slog.LevelInfo
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return 0, false
+	}
+	return level, true
+}
+
+// ParseComponentLevels parses "Component=level[,Component=level...]"
+func ParseComponentLevels(s string) (map[string]slog.Level, error) {
+	levels := map[string]slog.Level{}
+	for _, part := range strings.Split(s, ",") {
+		component, name, found := strings.Cut(part, "=")
+		if !found || component == "" {
+			return nil, fmt.Errorf("invalid component level %q", part)
+		}
+		level, ok := ParseLevel(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown level %q", name)
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLevelHandler(t *testing.T) {
+	var buf bytes.Buffer
+	text := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	levels := map[string]slog.Level{"Chatty": slog.LevelWarn, "Debugged": slog.LevelDebug}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(NewLevelHandler(text, slog.LevelInfo, levels)))
+
+	New("Chatty").Info("chatty info")
+	New("Chatty").Warn("chatty warn")
+	New("Debugged").Debug("debugged debug")
+	New("Other").Debug("other debug")
+	New("Other").With("id", 1).Info("other info")
+	New("").Info("main info")
+
+	out := buf.String()
+	for _, want := range []string{
+		`msg="chatty warn" component=Chatty`,
+		`msg="debugged debug" component=Debugged`,
+		`msg="other info" component=Other id=1`,
+		`msg="main info"` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lacks %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"chatty info", "other debug"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("output has %q:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestParseComponentLevels(t *testing.T) {
+	levels, err := ParseComponentLevels("Chain=debug,Health=WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if levels["Chain"] != slog.LevelDebug || levels["Health"] != slog.LevelWarn {
+		t.Errorf("ParseComponentLevels = %v", levels)
+	}
+	for _, s := range []string{"Chain", "=debug", "Chain=verbose", "Chain=debug,"} {
+		if _, err := ParseComponentLevels(s); err == nil {
+			t.Errorf("ParseComponentLevels(%q) succeeded", s)
+		}
+	}
+}
@@ -2,67 +2,391 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/dnschecktool/dow-proxy/blocklist"
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/dnschecktool/dow-proxy/dns64"
+	"github.com/dnschecktool/dow-proxy/dnshandler"
+	"github.com/dnschecktool/dow-proxy/dnssec"
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/dnschecktool/dow-proxy/framing"
+	"github.com/dnschecktool/dow-proxy/health"
+	"github.com/dnschecktool/dow-proxy/internal/extconnect"
+	"github.com/dnschecktool/dow-proxy/internal/netutil"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/dnschecktool/dow-proxy/querylog"
+	"github.com/dnschecktool/dow-proxy/rewrite"
+	"github.com/dnschecktool/dow-proxy/rrl"
+	"github.com/dnschecktool/dow-proxy/servertls"
+	"github.com/dnschecktool/dow-proxy/wshandler"
 	"github.com/miekg/dns"
 )
 
+var mainLog = logging.New("")
+
 var (
-	Verbose              bool
 	ListenAddr           string
-	UpstreamAddr         string
-	Upstream             Forwarder
+	UpstreamAddrs        stringList
 	BootstrapServer      string
 	Insecure             bool
 	Server               bool
-	TLSCertFile          string
-	TLSKeyFile           string
+	TLSCertFiles         stringList
+	TLSKeyFiles          stringList
+	TLSMinVersion        string
+	TLSMaxVersion        string
+	TLSCipherSuites      string
+	TLSCurves            string
+	ACMEDomains          stringList
+	ACMEDirectory        string
+	ACMECacheDir         string
+	ACMEEmail            string
+	ACMECAFile           string
+	ACMEHTTPListenAddr   string
+	TSIGKeysFile         string
+	TSIGKeyName          string
+	RequireTSIG          bool
 	UDPBufferSize        uint
 	WSBufferSize         uint
+	WSSubprotocols       string
+	WSBatchSize          uint
+	WSBatchDelay         time.Duration
+	WSCompression        bool
+	WSCompressionLevel   uint
+	WSCompressionMinSize uint
+	WSJSON               bool
+	WSHTTP2              bool
 	MaxWebSockets        uint
 	RequestsPerWebSocket uint
+	WSRelayBuffer        uint
 	Timeout              time.Duration
-	WebSocketReadLimit   int64 = 4096
+	BlocklistFiles       stringList
+	BlocklistReload      time.Duration
+	ANYMode              string
+	DenyTypes            string
+	BlockUDPTransfers    bool
+	MaxResponseSize      uint
+	RewriteFile          string
+	UpdatePrimary        string
+	UpdateAllow          stringList
+	ECSMode              string
+	ECSIPv4Prefix        uint
+	ECSIPv6Prefix        uint
+	DNS64                bool
+	DNS64Prefix          string
+	DNS64Exclude         stringList
+	DNSSEC               bool
+	DNSSECAnchorFile     string
+	RRLRate              uint
+	RRLSlip              uint
+	RRLWindow            time.Duration
+	RRLLogOnly           bool
+	QueryLogDest         string
+	QueryLogMaxSize      uint
+	QueryLogMaxBackups   uint
+	QueryLogSample       float64
+	HealthListenAddr     string
+	CanaryInterval       time.Duration
+	CanaryQuery          string
+	HealthRise           uint
+	HealthFall           uint
 )
 
 func main() {
-	flag.BoolVar(&Verbose, "verbose", false, "Verbose output")
+	var verbose bool
+	var logLevel, logFormat, logComponentLevels string
+	flag.BoolVar(&verbose, "verbose", false, "Verbose output, same as -log-level debug")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum `level` of log messages: debug, info, warn, or error")
+	flag.StringVar(&logFormat, "log-format", "text", "Log `format`: text or json")
+	flag.StringVar(&logComponentLevels, "log-component-level", "", "Per component log level `overrides`, given as \"Component=level[,Component=level...]\", e.g. \"WebSocketForwarder=debug,WebSocketHandler=warn\"")
 	flag.StringVar(&ListenAddr, "listen", "", "Listening `[IP]:port`. IP is optional, leave empty to listen on all interfaces. (default \":53\", \":80\", or \":443\" depending on server and TLS options)")
-	flag.StringVar(&UpstreamAddr, "upstream", "", "Upstream DNS `server` IP address or URL")
+	flag.Var(&UpstreamAddrs, "upstream", "Upstream DNS `server` IP address or URL. May be repeated for failover, healthy upstreams are used in the given order.")
 	flag.StringVar(&BootstrapServer, "bootstrap", "", "An optional plaintext DNS `server` IP address to be used to resolve the upstream server domain name")
 	flag.BoolVar(&Insecure, "insecure", false, "Skip server certificate verification for upstream encrypted connections")
 	flag.BoolVar(&Server, "server", false, "Listen for WebSocket connections instead of plaintext DNS. Unless a TLS certificate and key are provided, the WebSocket connections will be unencrypted.")
-	flag.StringVar(&TLSCertFile, "tls-cert", "", "TLS certificate `file` path for encrypting WebSocket connections in server mode")
-	flag.StringVar(&TLSKeyFile, "tls-key", "", "TLS private key `file` path for encrypting WebSocket connections in server mode")
+	flag.Var(&TLSCertFiles, "tls-cert", "TLS certificate `file` path for encrypting WebSocket connections in server mode. May be repeated together with -tls-key, the first certificate matching the server name and algorithms of the client is used. Changed files are loaded without a restart.")
+	flag.Var(&TLSKeyFiles, "tls-key", "TLS private key `file` path for encrypting WebSocket connections in server mode, one for every -tls-cert")
+	flag.StringVar(&TLSMinVersion, "tls-min-version", "1.3", "Minimum TLS `version` accepted in server mode: 1.0, 1.1, 1.2, or 1.3")
+	flag.StringVar(&TLSMaxVersion, "tls-max-version", "1.3", "Maximum TLS `version` accepted in server mode: 1.0, 1.1, 1.2, or 1.3")
+	flag.StringVar(&TLSCipherSuites, "tls-ciphers", "", "Comma separated list of cipher `suites` for TLS 1.2 and earlier in server mode, e.g. \"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256\" (default the Go defaults)")
+	flag.StringVar(&TLSCurves, "tls-curves", "", "Comma separated list of key exchange `curves` in order of preference in server mode: X25519, P256, P384, P521, or X25519MLKEM768 (default the Go defaults)")
+	flag.Var(&ACMEDomains, "acme-domain", "In server mode, obtain and renew a TLS certificate for `domain` with ACME instead of using -tls-cert and -tls-key. TLS-ALPN-01 challenges are answered on the WebSocket listener. May be repeated.")
+	flag.StringVar(&ACMEDirectory, "acme-directory", "https://acme-v02.api.letsencrypt.org/directory", "ACME directory `URL` used with -acme-domain")
+	flag.StringVar(&ACMECacheDir, "acme-cache", "acme-cache", "Cache `directory` keeping the ACME account key and certificates across restarts. Leave empty to keep them in memory only.")
+	flag.StringVar(&ACMEEmail, "acme-email", "", "Optional contact `email` address of the ACME account")
+	flag.StringVar(&ACMECAFile, "acme-ca", "", "CA certificates `file` trusted for the ACME directory, such as the one of a test server like Pebble (default the system roots)")
+	flag.StringVar(&ACMEHTTPListenAddr, "acme-http-listen", "", "Listening `[IP]:port` answering ACME HTTP-01 challenges, usually \":80\". Other requests are redirected to HTTPS. Leave empty to only answer TLS-ALPN-01 challenges.")
+	flag.StringVar(&TSIGKeysFile, "tsig-keys", "", "TSIG keys `file` with one \"hmac-sha256:name:secret\" per line. In server mode, WebSocket queries signed with one of the keys are verified and answered with signed responses.")
+	flag.StringVar(&TSIGKeyName, "tsig-key", "", "Sign queries sent upstream with the key `name` from the -tsig-keys file, and require signed responses. Queries signed by the client are sent as they are.")
+	flag.BoolVar(&RequireTSIG, "tsig-require", false, "In server mode, answer WebSocket queries not signed with one of the -tsig-keys with NOTAUTH, including those signed by clients with their own keys")
 	flag.UintVar(&UDPBufferSize, "udp-buffer", 1232, "EDNS UDP buffer size in `bytes`")
 	flag.UintVar(&WSBufferSize, "ws-buffer", 512, "WebSocket read and write buffer size in `bytes`")
+	flag.StringVar(&WSSubprotocols, "ws-subprotocols", framing.V1, "WebSocket `subprotocols` offered to upstreams, or accepted in server mode, as a comma separated list in order of preference: dns.v1 (one DNS message per WebSocket message) or dns.batch.v1 (several length-prefixed DNS messages per WebSocket message). Peers without any of them use dns.v1 framing.")
+	flag.UintVar(&WSBatchSize, "ws-batch-size", 4096, "Maximum size in `bytes` of a WebSocket message carrying a batch of DNS messages with dns.batch.v1")
+	flag.DurationVar(&WSBatchDelay, "ws-batch-delay", time.Millisecond, "Maximum time `duration` a DNS message waits for others to be batched with, with dns.batch.v1")
+	flag.BoolVar(&WSCompression, "ws-compression", false, "Negotiate permessage-deflate compression of WebSocket messages, without context takeover. Off by default since compressing encrypted traffic can leak its contents, as in CRIME-style attacks.")
+	flag.UintVar(&WSCompressionLevel, "ws-compression-level", 1, "Compression `level` from 1 (fastest) to 9 (smallest) used with -ws-compression")
+	flag.UintVar(&WSCompressionMinSize, "ws-compression-min-size", 256, "WebSocket messages smaller than `bytes` are sent uncompressed with -ws-compression")
+	flag.BoolVar(&WSJSON, "ws-json", false, "In server mode, also accept text WebSocket messages with JSON queries like {\"name\":\"example.com\",\"type\":\"AAAA\",\"id\":1}, answered in the JSON format of the Google and Cloudflare DNS over HTTPS APIs")
+	flag.BoolVar(&WSHTTP2, "ws-http2", false, "Open WebSockets to wss:// upstreams with HTTP/2 extended CONNECT (RFC 8441) if they support it, so that they share one connection, and with HTTP/1.1 upgrades otherwise")
 	flag.UintVar(&MaxWebSockets, "max-ws", 50, "Maximum `number` of WebSockets to serve simultaneously")
 	flag.UintVar(&RequestsPerWebSocket, "requests-per-ws", 50, "Maximum `number` of open DNS requests per WebSocket. Additional requests will be refused.")
+	flag.UintVar(&WSRelayBuffer, "ws-relay-buffer", 1<<20, "Maximum size in `bytes` of zone transfer responses from a WebSocket upstream waiting for a slow client. Transfers falling further behind are cut off.")
 	flag.DurationVar(&Timeout, "timeout", 5*time.Second, "Maximum allowed time `duration` to wait for network activities")
+	flag.Var(&BlocklistFiles, "blocklist", "Block queries for domains listed in `list`, given as \"file[,format=domains|hosts|adblock|rpz][,policy=nxdomain|nodata|refused|sinkhole:IP]\". May be repeated, the first matching list wins. (default format domains, default policy nxdomain)")
+	flag.DurationVar(&BlocklistReload, "blocklist-reload", 0, "Interval `duration` between checks for changed blocklist files. Leave 0 to disable reloading.")
+	flag.StringVar(&ANYMode, "any", "pass", "Handling `policy` for ANY queries: pass (forward), refuse, or minimize (answer with a HINFO record as described in RFC 8482)")
+	flag.StringVar(&DenyTypes, "deny-types", "", "Refuse queries for the query `types` in this comma separated list, e.g. \"NULL,HINFO,TYPE65\"")
+	flag.BoolVar(&BlockUDPTransfers, "block-udp-xfr", true, "Refuse AXFR and IXFR queries over UDP")
+	flag.UintVar(&MaxResponseSize, "max-response-size", 0, "Refuse queries whose response is larger than `bytes`. Leave 0 to disable the limit.")
+	flag.StringVar(&UpdatePrimary, "update-primary", "", "Forward NOTIFY and dynamic UPDATE messages to the primary `server`, given as an IP address or URL like -upstream. Messages signed with TSIG are forwarded unchanged.")
+	flag.Var(&UpdateAllow, "update-allow", "Allow NOTIFY and UPDATE messages from clients in `network`, an IP address or prefix such as 192.0.2.0/24. May be repeated.")
+	flag.StringVar(&RewriteFile, "rewrite", "", "Rewrite queries and responses following the rules in `file`")
+	flag.StringVar(&ECSMode, "ecs", "pass", "EDNS Client Subnet `policy` for queries from this listener: pass (forward as received), strip (remove), or add (replace with the truncated client address)")
+	flag.UintVar(&ECSIPv4Prefix, "ecs-ipv4-prefix", 24, "Prefix `length` of IPv4 client addresses added with -ecs add")
+	flag.UintVar(&ECSIPv6Prefix, "ecs-ipv6-prefix", 56, "Prefix `length` of IPv6 client addresses added with -ecs add")
+	flag.BoolVar(&DNS64, "dns64", false, "Synthesize AAAA records from A records for names without AAAA records, for IPv6-only clients behind NAT64")
+	flag.StringVar(&DNS64Prefix, "dns64-prefix", "64:ff9b::/96", "NAT64 `prefix` used with -dns64, of length 32, 40, 48, 56, 64, or 96")
+	flag.Var(&DNS64Exclude, "dns64-exclude", "Never synthesize AAAA records for `domain` and its subdomains. May be repeated.")
+	flag.BoolVar(&DNSSEC, "dnssec", false, "Validate answers with DNSSEC for clients not setting the CD bit. Bogus answers are replaced with SERVFAIL.")
+	flag.StringVar(&DNSSECAnchorFile, "dnssec-anchors", "", "Trust anchor `file` with DS or DNSKEY records in zone file format (default the root zone KSKs)")
+	flag.UintVar(&RRLRate, "rrl-rate", 0, "Response rate limit: maximum `number` of identical UDP responses per second to a client network (/24 or /56). Leave 0 to disable limiting.")
+	flag.UintVar(&RRLSlip, "rrl-slip", 2, "Send every `number`th rate limited response truncated, so clients can retry over TCP, and drop the others. 0 drops all of them.")
+	flag.DurationVar(&RRLWindow, "rrl-window", 15*time.Second, "Time `duration` over which responses are counted for rate limiting")
+	flag.BoolVar(&RRLLogOnly, "rrl-log-only", false, "Only log which responses would be rate limited")
+	flag.StringVar(&QueryLogDest, "querylog", "", "Log every query to `destination`: a file path or \"-\" for JSON lines on stdout, or \"dnstap:/path/to/socket\" for dnstap frames on a unix socket")
+	flag.UintVar(&QueryLogMaxSize, "querylog-max-size", 0, "Rotate the query log file once it reaches `megabytes`. Leave 0 to disable rotation.")
+	flag.UintVar(&QueryLogMaxBackups, "querylog-max-backups", 5, "Maximum `number` of rotated query log files to keep")
+	flag.Float64Var(&QueryLogSample, "querylog-sample", 1, "Fraction of queries to log, from 0 to 1. 0 disables the query log.")
+	flag.StringVar(&HealthListenAddr, "health-listen", "", "Listening `[IP]:port` for the /healthz, /readyz and /metrics HTTP endpoints. In server mode the endpoints are also served on the WebSocket listener.")
+	flag.DurationVar(&CanaryInterval, "canary-interval", 30*time.Second, "Interval `duration` between canary queries used to check upstream health")
+	flag.StringVar(&CanaryQuery, "canary", ". NS", "Canary `query` sent to every upstream, given as \"name type\"")
+	flag.UintVar(&HealthRise, "health-rise", 2, "Consecutive successful canary queries (`number`) before an unhealthy upstream is used again")
+	flag.UintVar(&HealthFall, "health-fall", 3, "Consecutive failed canary queries (`number`) before an upstream is marked unhealthy")
 	flag.Parse()
 
+	level, ok := logging.ParseLevel(logLevel)
+	if !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -log-level: unknown level\n", logLevel)
+		flag.Usage()
+		os.Exit(2)
+	} else if verbose {
+		level = slog.LevelDebug
+	}
+
+	// the handler writes everything, LevelHandler filters
+	handlerOptions := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var logHandler slog.Handler
+	switch logFormat {
+	case "text":
+		logHandler = slog.NewTextHandler(os.Stderr, handlerOptions)
+	case "json":
+		logHandler = slog.NewJSONHandler(os.Stderr, handlerOptions)
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -log-format: unknown format\n", logFormat)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var componentLevels map[string]slog.Level
+	if logComponentLevels != "" {
+		levels, err := logging.ParseComponentLevels(logComponentLevels)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -log-component-level: %v\n", logComponentLevels, err)
+			flag.Usage()
+			os.Exit(2)
+		}
+		componentLevels = levels
+	}
+	slog.SetDefault(slog.New(logging.NewLevelHandler(logHandler, level, componentLevels)))
+
 	if UDPBufferSize < 512 || UDPBufferSize > 4096 {
 		fmt.Fprintf(flag.CommandLine.Output(), "invalid value \"%d\" for flag -udp-buffer: valid range is 512 to 4096\n", UDPBufferSize)
 		flag.Usage()
 		os.Exit(2)
 	}
 
+	wsSubprotocols, err := framing.ParseList(WSSubprotocols)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -ws-subprotocols: %v\n", WSSubprotocols, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if WSBatchSize < 512 || WSBatchSize > 65535 {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value \"%d\" for flag -ws-batch-size: valid range is 512 to 65535\n", WSBatchSize)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if WSBatchDelay < 100*time.Microsecond || WSBatchDelay > 100*time.Millisecond {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -ws-batch-delay: valid range is 100µs to 100ms\n", WSBatchDelay.String())
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if WSCompressionLevel < 1 || WSCompressionLevel > 9 {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value \"%d\" for flag -ws-compression-level: valid range is 1 to 9\n", WSCompressionLevel)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if WSCompressionMinSize == 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "invalid value \"0\" for flag -ws-compression-min-size: minimum is 1")
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	if Timeout < time.Second {
 		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -timeout: minimum is 1s\n", Timeout.String())
 		flag.Usage()
 		os.Exit(2)
 	}
 
+	if QueryLogSample < 0 || QueryLogSample > 1 {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value \"%v\" for flag -querylog-sample: valid range is 0 to 1\n", QueryLogSample)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	anyMode, err := chain.ParseANYMode(ANYMode)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -any: %v\n", ANYMode, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	denyTypes, err := chain.ParseTypes(DenyTypes)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -deny-types: %v\n", DenyTypes, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if MaxResponseSize != 0 && MaxResponseSize < 512 {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value \"%d\" for flag -max-response-size: minimum is 512\n", MaxResponseSize)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ecsMode, err := chain.ParseECSMode(ECSMode)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -ecs: %v\n", ECSMode, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if ECSIPv4Prefix > 32 {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value \"%d\" for flag -ecs-ipv4-prefix: valid range is 0 to 32\n", ECSIPv4Prefix)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if ECSIPv6Prefix > 128 {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value \"%d\" for flag -ecs-ipv6-prefix: valid range is 0 to 128\n", ECSIPv6Prefix)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dns64Prefix, err := dns64.ParsePrefix(DNS64Prefix)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -dns64-prefix: %v\n", DNS64Prefix, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	for _, name := range DNS64Exclude {
+		if _, ok := dns.IsDomainName(name); !ok {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -dns64-exclude: invalid domain\n", name)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	if RRLSlip > 10 {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value \"%d\" for flag -rrl-slip: valid range is 0 to 10\n", RRLSlip)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if RRLWindow < time.Second || RRLWindow > time.Hour {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -rrl-window: valid range is 1s to 1h\n", RRLWindow.String())
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if CanaryInterval < time.Second {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -canary-interval: minimum is 1s\n", CanaryInterval.String())
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	canary, err := health.ParseCanary(CanaryQuery)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -canary: %v\n", CanaryQuery, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if HealthRise == 0 || HealthFall == 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "invalid value \"0\" for flag -health-rise or -health-fall: minimum is 1")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if len(ACMEDomains) != 0 && (len(TLSCertFiles) != 0 || len(TLSKeyFiles) != 0) {
+		fmt.Fprintln(flag.CommandLine.Output(), "invalid value for flag -acme-domain: cannot be combined with -tls-cert and -tls-key")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if len(TLSCertFiles) != len(TLSKeyFiles) {
+		fmt.Fprintln(flag.CommandLine.Output(), "invalid value for flag -tls-cert or -tls-key: every certificate needs a key")
+		flag.Usage()
+		os.Exit(2)
+	}
+	serveTLS := len(TLSCertFiles) != 0 || len(ACMEDomains) != 0
+
+	var tlsPolicy servertls.Policy
+	if tlsPolicy.MinVersion, err = servertls.ParseVersion(TLSMinVersion); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -tls-min-version: %v\n", TLSMinVersion, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if tlsPolicy.MaxVersion, err = servertls.ParseVersion(TLSMaxVersion); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -tls-max-version: %v\n", TLSMaxVersion, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if tlsPolicy.MaxVersion < tlsPolicy.MinVersion {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -tls-max-version: lower than -tls-min-version\n", TLSMaxVersion)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if tlsPolicy.CipherSuites, err = servertls.ParseCipherSuites(TLSCipherSuites); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -tls-ciphers: %v\n", TLSCipherSuites, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if tlsPolicy.CurvePreferences, err = servertls.ParseCurves(TLSCurves); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -tls-curves: %v\n", TLSCurves, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	var defaultListenPort int
 	if Server {
-		if TLSCertFile == "" || TLSKeyFile == "" {
+		if !serveTLS {
 			defaultListenPort = 80
 		} else {
 			defaultListenPort = 443
@@ -71,7 +395,7 @@ func main() {
 		defaultListenPort = 53
 	}
 
-	if addr := getHostPort(ListenAddr, defaultListenPort, false, true); addr == "" {
+	if addr := netutil.HostPort(ListenAddr, defaultListenPort, false, true); addr == "" {
 		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -listen: invalid address\n", ListenAddr)
 		flag.Usage()
 		os.Exit(2)
@@ -79,8 +403,64 @@ func main() {
 		ListenAddr = addr
 	}
 
+	if HealthListenAddr != "" {
+		if addr := netutil.HostPort(HealthListenAddr, 0, false, true); addr == "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -health-listen: invalid address\n", HealthListenAddr)
+			flag.Usage()
+			os.Exit(2)
+		} else {
+			HealthListenAddr = addr
+		}
+	}
+
+	if ACMEHTTPListenAddr != "" {
+		if addr := netutil.HostPort(ACMEHTTPListenAddr, 80, false, true); addr == "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -acme-http-listen: invalid address\n", ACMEHTTPListenAddr)
+			flag.Usage()
+			os.Exit(2)
+		} else {
+			ACMEHTTPListenAddr = addr
+		}
+	}
+
+	var acme *servertls.ACME
+	if len(ACMEDomains) != 0 {
+		var rootCAs *x509.CertPool
+		if ACMECAFile != "" {
+			pem, err := os.ReadFile(ACMECAFile)
+			if err != nil {
+				fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -acme-ca: %v\n", ACMECAFile, err)
+				flag.Usage()
+				os.Exit(2)
+			}
+			rootCAs = x509.NewCertPool()
+			if !rootCAs.AppendCertsFromPEM(pem) {
+				fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -acme-ca: no PEM certificates\n", ACMECAFile)
+				flag.Usage()
+				os.Exit(2)
+			}
+		}
+		acme = servertls.NewACME(servertls.ACMEConfig{
+			Domains:      ACMEDomains,
+			DirectoryURL: ACMEDirectory,
+			CacheDir:     ACMECacheDir,
+			Email:        ACMEEmail,
+			RootCAs:      rootCAs,
+		})
+	}
+
+	var certificates *servertls.Certificates
+	if len(TLSCertFiles) != 0 {
+		certificates, err = servertls.LoadCertificates(TLSCertFiles, TLSKeyFiles)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -tls-cert or -tls-key: %v\n", TLSCertFiles.String(), err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
 	if BootstrapServer != "" {
-		if addr := getHostPort(BootstrapServer, 53, true, true); addr == "" {
+		if addr := netutil.HostPort(BootstrapServer, 53, true, true); addr == "" {
 			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -bootstrap: invalid address\n", BootstrapServer)
 			flag.Usage()
 			os.Exit(2)
@@ -89,92 +469,389 @@ func main() {
 		}
 	}
 
-	if UpstreamAddr == "" {
+	if len(UpstreamAddrs) == 0 {
 		fmt.Fprintln(flag.CommandLine.Output(), "flag required: -upstream")
 		flag.Usage()
 		os.Exit(2)
 	}
 
-	Upstream = NewForwarder(UpstreamAddr)
-	if Upstream == nil {
-		fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -upstream: invalid address\n", UpstreamAddr)
+	var tsigKeys map[string]*forwarder.TSIGKey
+	if TSIGKeysFile != "" {
+		tsigKeys, err = forwarder.LoadTSIGKeys(TSIGKeysFile)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -tsig-keys: %v\n", TSIGKeysFile, err)
+			flag.Usage()
+			os.Exit(2)
+		}
+	} else if TSIGKeyName != "" || RequireTSIG {
+		fmt.Fprintln(flag.CommandLine.Output(), "flag required with -tsig-key or -tsig-require: -tsig-keys")
 		flag.Usage()
 		os.Exit(2)
 	}
-	defer Upstream.Close()
 
-	if Verbose {
-		log.Printf(
-			"upstream=%v, bootstrap=%v, insecure=%v, udp-buffer=%v, ws-buffer=%v, max-ws=%v, requests-per-ws=%v, timeout=%v",
-			Upstream.Address(),
-			BootstrapServer,
-			Insecure,
-			UDPBufferSize,
-			WSBufferSize,
-			MaxWebSockets,
-			RequestsPerWebSocket,
-			Timeout.String(),
-		)
+	var tsigKey *forwarder.TSIGKey
+	if TSIGKeyName != "" {
+		tsigKey = tsigKeys[dns.CanonicalName(TSIGKeyName)]
+		if tsigKey == nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -tsig-key: no such key in %s\n", TSIGKeyName, TSIGKeysFile)
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	forwarderConfig := forwarder.Config{
+		Timeout:              Timeout,
+		UDPBufferSize:        uint16(UDPBufferSize),
+		WSBufferSize:         int(WSBufferSize),
+		RequestsPerWebSocket: int(RequestsPerWebSocket),
+		RelayBufferSize:      int(WSRelayBuffer),
+		BootstrapServer:      BootstrapServer,
+		Insecure:             Insecure,
+		Subprotocols:         wsSubprotocols,
+		BatchSize:            int(WSBatchSize),
+		BatchDelay:           WSBatchDelay,
+		Compression:          WSCompression,
+		CompressionLevel:     int(WSCompressionLevel),
+		CompressionMinSize:   int(WSCompressionMinSize),
+		HTTP2:                WSHTTP2,
+		TSIGKey:              tsigKey,
+	}
+
+	var upstreams []forwarder.Forwarder
+	var upstreamChecks []*health.UpstreamCheck
+	for _, addr := range UpstreamAddrs {
+		f := forwarder.New(addr, forwarderConfig)
+		if f == nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -upstream: invalid address\n", addr)
+			flag.Usage()
+			os.Exit(2)
+		}
+		upstreams = append(upstreams, f)
+		upstreamChecks = append(upstreamChecks, health.NewUpstreamCheck(f, int(HealthRise), int(HealthFall)))
+	}
+
+	var updateAllow []netip.Prefix
+	for _, s := range UpdateAllow {
+		network, err := chain.ParseNetwork(s)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -update-allow: %v\n", s, err)
+			flag.Usage()
+			os.Exit(2)
+		}
+		updateAllow = append(updateAllow, network)
+	}
+
+	var updatePrimary forwarder.Forwarder
+	if UpdatePrimary != "" {
+		if len(updateAllow) == 0 {
+			fmt.Fprintln(flag.CommandLine.Output(), "flag required with -update-primary: -update-allow")
+			flag.Usage()
+			os.Exit(2)
+		}
+		updatePrimary = forwarder.New(UpdatePrimary, forwarderConfig)
+		if updatePrimary == nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -update-primary: invalid address\n", UpdatePrimary)
+			flag.Usage()
+			os.Exit(2)
+		}
+		defer updatePrimary.Close()
+	}
+
+	var upstream forwarder.Forwarder
+	if len(upstreams) == 1 {
+		upstream = upstreams[0]
+	} else {
+		upstream = &forwarder.FailoverForwarder{
+			Upstreams: upstreams,
+			Healthy:   func(i int) bool { return upstreamChecks[i].Healthy() },
+		}
+	}
+
+	defer upstream.Close()
+
+	var filter *blocklist.Filter
+	if len(BlocklistFiles) != 0 {
+		var blocklists []*blocklist.Blocklist
+		for _, s := range BlocklistFiles {
+			l, err := blocklist.New(s)
+			if err == nil {
+				err = l.Load()
+			}
+			if err != nil {
+				fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -blocklist: %v\n", s, err)
+				flag.Usage()
+				os.Exit(2)
+			}
+			blocklists = append(blocklists, l)
+		}
+		filter = blocklist.NewFilter(blocklists, blocklist.Config{
+			ReloadInterval: BlocklistReload,
+			UDPBufferSize:  uint16(UDPBufferSize),
+		})
+		defer filter.Close()
+	}
+
+	var queryLog querylog.Logger
+	if QueryLogDest != "" && QueryLogSample > 0 {
+		queryLog, err = querylog.New(QueryLogDest, querylog.Config{
+			MaxSize:    int64(QueryLogMaxSize) << 20,
+			MaxBackups: int(QueryLogMaxBackups),
+			Sample:     QueryLogSample,
+			Timeout:    Timeout,
+		})
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -querylog: %v\n", QueryLogDest, err)
+			flag.Usage()
+			os.Exit(2)
+		}
+		defer queryLog.Close()
+	}
+
+	stages := []chain.Stage{
+		chain.Validate(uint16(UDPBufferSize)),
+		chain.Truncate(uint16(UDPBufferSize)),
+	}
+	if queryLog != nil {
+		stages = append(stages, chain.Log(queryLog))
+	}
+	stages = append(stages, chain.Updates(chain.UpdatePolicy{
+		Primary:       updatePrimary,
+		Allow:         updateAllow,
+		UDPBufferSize: uint16(UDPBufferSize),
+	}))
+	if RRLRate != 0 {
+		limiter := rrl.New(rrl.Config{
+			ResponsesPerSecond: int(RRLRate),
+			Slip:               int(RRLSlip),
+			Window:             RRLWindow,
+			LogOnly:            RRLLogOnly,
+			UDPBufferSize:      uint16(UDPBufferSize),
+		})
+		stages = append(stages, limiter.Stage)
+	}
+	stages = append(stages, chain.QueryTypes(chain.QtypePolicy{
+		ANY:               anyMode,
+		BlockUDPTransfers: BlockUDPTransfers,
+		Deny:              denyTypes,
+		MaxResponseSize:   int(MaxResponseSize),
+		UDPBufferSize:     uint16(UDPBufferSize),
+	}))
+	if filter != nil {
+		stages = append(stages, filter.Stage)
+	}
+	stages = append(stages, chain.ClientSubnet(chain.ECSPolicy{
+		Mode:          ecsMode,
+		IPv4Prefix:    uint8(ECSIPv4Prefix),
+		IPv6Prefix:    uint8(ECSIPv6Prefix),
+		UDPBufferSize: uint16(UDPBufferSize),
+	}))
+	if RewriteFile != "" {
+		rules, err := rewrite.Load(RewriteFile)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -rewrite: %v\n", RewriteFile, err)
+			flag.Usage()
+			os.Exit(2)
+		}
+		stages = append(stages, rules.Stage)
+	}
+	if DNS64 {
+		stages = append(stages, dns64.Stage(dns64.Config{
+			Prefix:  dns64Prefix,
+			Exclude: DNS64Exclude,
+		}))
+	}
+	if DNSSEC {
+		var anchors []dns.RR
+		if DNSSECAnchorFile != "" {
+			anchors, err = dnssec.LoadAnchors(DNSSECAnchorFile)
+			if err != nil {
+				fmt.Fprintf(flag.CommandLine.Output(), "invalid value %q for flag -dnssec-anchors: %v\n", DNSSECAnchorFile, err)
+				flag.Usage()
+				os.Exit(2)
+			}
+		}
+		validator := dnssec.New(upstream, dnssec.Config{
+			Anchors:       anchors,
+			UDPBufferSize: uint16(UDPBufferSize),
+		})
+		stages = append(stages, validator.Stage)
+	}
+	handler := chain.New(chain.Forward(upstream, uint16(UDPBufferSize)), stages...)
+
+	mainLog.Debug(
+		"Configuration",
+		"upstream", UpstreamAddrs.String(),
+		"bootstrap", BootstrapServer,
+		"insecure", Insecure,
+		"udp-buffer", UDPBufferSize,
+		"ws-buffer", WSBufferSize,
+		"max-ws", MaxWebSockets,
+		"requests-per-ws", RequestsPerWebSocket,
+		"timeout", Timeout.String(),
+		"blocklists", len(BlocklistFiles),
+	)
+
+	monitor := health.New(CanaryInterval, Timeout, canary, upstreamChecks)
+	go monitor.Run()
+	defer monitor.Close()
+
+	var wsHandler *wshandler.Handler
+	if Server {
+		wsHandler = wshandler.New(wshandler.Config{
+			Handler:              handler,
+			Timeout:              Timeout,
+			UDPBufferSize:        uint16(UDPBufferSize),
+			WSBufferSize:         int(WSBufferSize),
+			MaxWebSockets:        int(MaxWebSockets),
+			RequestsPerWebSocket: int(RequestsPerWebSocket),
+			TrustRealIP:          !serveTLS,
+			Subprotocols:         wsSubprotocols,
+			BatchSize:            int(WSBatchSize),
+			BatchDelay:           WSBatchDelay,
+			Compression:          WSCompression,
+			CompressionLevel:     int(WSCompressionLevel),
+			CompressionMinSize:   int(WSCompressionMinSize),
+			JSON:                 WSJSON,
+			TSIGKeys:             tsigKeys,
+			RequireTSIG:          RequireTSIG,
+		})
+		monitor.WebSockets = wsHandler.OpenWebSockets
+	}
+
+	if HealthListenAddr != "" {
+		monitor.AddListener("health")
+		go func() {
+			mainLog.Info("Starting health listener", "addr", "http://"+HealthListenAddr)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/healthz", monitor.ServeHealthz)
+			mux.HandleFunc("/readyz", monitor.ServeReadyz)
+			mux.HandleFunc("/metrics", monitor.ServeMetrics)
+			srv := &http.Server{
+				Handler:      mux,
+				ReadTimeout:  Timeout,
+				WriteTimeout: Timeout,
+			}
+			ln, err := net.Listen("tcp", HealthListenAddr)
+			if err != nil {
+				mainLog.Fatal("Listener error", "error", err)
+			}
+			monitor.SetListenerBound("health")
+			mainLog.Fatal("Listener error", "error", srv.Serve(ln))
+		}()
 	}
 
 	if Server {
-		http.Handle("/", newWebSocketHandler())
+		if !extconnect.ServerAvailable() && !extconnect.ServerDisabled() {
+			mainLog.Warn("HTTP/2 extended CONNECT is unavailable, set GODEBUG=http2xconnect=1 to enable it")
+		}
+		http.Handle("/", wsHandler)
+		http.HandleFunc("/healthz", monitor.ServeHealthz)
+		http.HandleFunc("/readyz", monitor.ServeReadyz)
+		http.HandleFunc("/metrics", monitor.ServeMetrics)
 
-		if TLSCertFile == "" || TLSKeyFile == "" {
+		if acme != nil && ACMEHTTPListenAddr != "" {
+			monitor.AddListener("acme-http")
 			go func() {
-				log.Printf("Starting WebSocket listener on ws://%v", ListenAddr)
+				mainLog.Info("Starting ACME HTTP-01 listener", "addr", "http://"+ACMEHTTPListenAddr)
 				srv := &http.Server{
-					Addr:         ListenAddr,
+					Handler:      acme.HTTPHandler(),
 					ReadTimeout:  Timeout,
 					WriteTimeout: Timeout,
 				}
-				log.Fatal(srv.ListenAndServe())
+				ln, err := net.Listen("tcp", ACMEHTTPListenAddr)
+				if err != nil {
+					mainLog.Fatal("Listener error", "error", err)
+				}
+				monitor.SetListenerBound("acme-http")
+				mainLog.Fatal("Listener error", "error", srv.Serve(ln))
+			}()
+		}
+
+		if !serveTLS {
+			monitor.AddListener("ws")
+			go func() {
+				mainLog.Info("Starting WebSocket listener", "addr", "ws://"+ListenAddr)
+				// HTTP/2 with prior knowledge for reverse proxies
+				protocols := new(http.Protocols)
+				protocols.SetHTTP1(true)
+				protocols.SetUnencryptedHTTP2(true)
+				srv := &http.Server{
+					ReadTimeout:  Timeout,
+					WriteTimeout: Timeout,
+					Protocols:    protocols,
+				}
+				ln, err := net.Listen("tcp", ListenAddr)
+				if err != nil {
+					mainLog.Fatal("Listener error", "error", err)
+				}
+				monitor.SetListenerBound("ws")
+				mainLog.Fatal("Listener error", "error", srv.Serve(ln))
 			}()
 		} else {
+			monitor.AddListener("wss")
 			go func() {
-				log.Printf("Starting WebSocket listener on wss://%v", ListenAddr)
+				mainLog.Info("Starting WebSocket listener", "addr", "wss://"+ListenAddr)
+				var tlsConfig *tls.Config
+				if acme != nil {
+					tlsConfig = acme.TLSConfig()
+				} else {
+					tlsConfig = &tls.Config{GetCertificate: certificates.GetCertificate}
+				}
+				tlsPolicy.Apply(tlsConfig)
 				srv := &http.Server{
-					Addr:         ListenAddr,
 					ReadTimeout:  Timeout,
 					WriteTimeout: Timeout,
-					TLSConfig: &tls.Config{
-						MinVersion: tls.VersionTLS13,
-					},
+					TLSConfig:    tlsConfig,
+				}
+				ln, err := net.Listen("tcp", ListenAddr)
+				if err != nil {
+					mainLog.Fatal("Listener error", "error", err)
 				}
-				log.Fatal(srv.ListenAndServeTLS(TLSCertFile, TLSKeyFile))
+				monitor.SetListenerBound("wss")
+				mainLog.Fatal("Listener error", "error", srv.ServeTLS(ln, "", ""))
 			}()
 		}
 
 	} else {
-		dns.HandleFunc(".", handleDNS)
+		dnsHandler := dnshandler.New(dnshandler.Config{
+			Handler:       handler,
+			UDPBufferSize: uint16(UDPBufferSize),
+		})
+		dns.Handle(".", dnsHandler)
 
+		monitor.AddListener("udp")
 		go func() {
-			log.Printf("Starting DNS (udp) listener on %v", ListenAddr)
+			mainLog.Info("Starting DNS listener", "net", "udp", "addr", ListenAddr)
 			srv := &dns.Server{
-				Addr:          ListenAddr,
-				Net:           "udp",
-				ReadTimeout:   Timeout,
-				WriteTimeout:  Timeout,
-				MsgAcceptFunc: acceptDNS,
+				Addr:              ListenAddr,
+				Net:               "udp",
+				ReadTimeout:       Timeout,
+				WriteTimeout:      Timeout,
+				MsgAcceptFunc:     dnshandler.AcceptDNS,
+				DecorateReader:    dnsHandler.DecorateReader,
+				NotifyStartedFunc: func() { monitor.SetListenerBound("udp") },
 			}
-			log.Fatal(srv.ListenAndServe())
+			mainLog.Fatal("Listener error", "error", srv.ListenAndServe())
 		}()
 
+		monitor.AddListener("tcp")
 		go func() {
-			log.Printf("Starting DNS (tcp) listener on %v", ListenAddr)
+			mainLog.Info("Starting DNS listener", "net", "tcp", "addr", ListenAddr)
 			srv := &dns.Server{
-				Addr:          ListenAddr,
-				Net:           "tcp",
-				ReadTimeout:   Timeout,
-				WriteTimeout:  Timeout,
-				MsgAcceptFunc: acceptDNS,
+				Addr:              ListenAddr,
+				Net:               "tcp",
+				ReadTimeout:       Timeout,
+				WriteTimeout:      Timeout,
+				MsgAcceptFunc:     dnshandler.AcceptDNS,
+				DecorateReader:    dnsHandler.DecorateReader,
+				NotifyStartedFunc: func() { monitor.SetListenerBound("tcp") },
 			}
-			log.Fatal(srv.ListenAndServe())
+			mainLog.Fatal("Listener error", "error", srv.ListenAndServe())
 		}()
 	}
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigs
-	log.Printf("Signal %v received, stopping", sig)
+	mainLog.Info("Signal received, stopping", "signal", sig.String())
 }
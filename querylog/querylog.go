@@ -0,0 +1,269 @@
+// Package querylog records finished queries as JSON lines or dnstap frames.
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/logging"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+var queryLogLog = logging.New("QueryLog")
+
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Transport string    `json:"transport"`
+	Name      string    `json:"qname"`
+	Type      string    `json:"qtype"`
+	Rcode     string    `json:"rcode"`
+	Upstream  string    `json:"upstream"`
+	Duration  float64   `json:"duration_ms"`
+	CacheHit  bool      `json:"cache_hit"`
+	Answers   int       `json:"answers"`
+	Query     *dns.Msg  `json:"-"`
+	Response  *dns.Msg  `json:"-"`
+}
+
+type Logger interface {
+	Log(*Entry)
+	Close()
+}
+
+type Config struct {
+	// Rotate the log file once it reaches MaxSize bytes, 0 disables rotation
+	MaxSize int64
+	// Maximum number of rotated log files to keep
+	MaxBackups int
+	// Fraction of queries to log, from 0 to 1. The zero value logs every
+	// query; to log none, do not create a Logger.
+	Sample float64
+	// Write timeout for dnstap frames
+	Timeout time.Duration
+}
+
+// New parses a destination: "-" for JSON lines on stdout,
+// "dnstap:/path/to/socket" for dnstap frames, or a file path for JSON lines.
+func New(dest string, cfg Config) (Logger, error) {
+	l, err := newLogger(dest, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Sample > 0 && cfg.Sample < 1 {
+		return &sampledLogger{Logger: l, Sample: cfg.Sample}, nil
+	}
+	return l, nil
+}
+
+func newLogger(s string, cfg Config) (Logger, error) {
+	if s == "-" {
+		return &JSONLogger{File: os.Stdout}, nil
+	}
+	if strings.HasPrefix(s, "dnstap:") {
+		return NewDnstapLogger(strings.TrimPrefix(s, "dnstap:"), cfg.Timeout)
+	}
+	f, err := os.OpenFile(s, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &JSONLogger{
+		Path:       s,
+		File:       f,
+		Size:       fi.Size(),
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+	}, nil
+}
+
+// NewEntry describes a query that was received at start and answered with resp
+func NewEntry(client string, transport string, upstream string, req *dns.Msg, resp *dns.Msg, start time.Time) *Entry {
+	q := req.Question[0]
+	return &Entry{
+		Time:      start,
+		Client:    client,
+		Transport: transport,
+		Name:      q.Name,
+		Type:      dns.TypeToString[q.Qtype],
+		Rcode:     dns.RcodeToString[resp.Rcode],
+		Upstream:  upstream,
+		Duration:  float64(time.Since(start).Microseconds()) / 1000,
+		Answers:   len(resp.Answer),
+		Query:     req,
+		Response:  resp,
+	}
+}
+
+type sampledLogger struct {
+	Logger
+	Sample float64
+}
+
+func (l *sampledLogger) Log(e *Entry) {
+	if rand.Float64() < l.Sample {
+		l.Logger.Log(e)
+	}
+}
+
+// JSONLogger writes one JSON object per line. Files are rotated once
+// they reach MaxSize bytes, keeping MaxBackups old files (path.1, path.2...).
+type JSONLogger struct {
+	Path       string
+	File       *os.File
+	Size       int64
+	MaxSize    int64
+	MaxBackups int
+	Mutex      sync.Mutex
+}
+
+func (l *JSONLogger) Log(e *Entry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		queryLogLog.Error("Marshal error", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if l.File == nil {
+		return
+	}
+	if l.Path != "" && l.MaxSize > 0 && l.Size+int64(len(line)) > l.MaxSize && l.Size > 0 {
+		if err = l.rotate(); err != nil {
+			queryLogLog.Error("Rotate error", "path", l.Path, "error", err)
+			return
+		}
+	}
+	n, err := l.File.Write(line)
+	l.Size += int64(n)
+	if err != nil {
+		queryLogLog.Error("Write error", "path", l.Path, "error", err)
+	}
+}
+
+func (l *JSONLogger) rotate() error {
+	l.File.Close()
+	l.File = nil
+	for i := l.MaxBackups; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%d", l.Path, i-1), fmt.Sprintf("%v.%d", l.Path, i))
+	}
+	if l.MaxBackups > 0 {
+		os.Rename(l.Path, l.Path+".1")
+	}
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.File = f
+	l.Size = 0
+	return nil
+}
+
+func (l *JSONLogger) Close() {
+	l.Mutex.Lock()
+	if l.File != nil && l.File != os.Stdout {
+		l.File.Close()
+	}
+	l.File = nil
+	l.Mutex.Unlock()
+}
+
+// DnstapLogger sends CLIENT_RESPONSE messages as Frame Streams to a
+// dnstap collector listening on a unix socket
+type DnstapLogger struct {
+	Identity []byte
+	Output   *dnstap.FrameStreamSockOutput
+}
+
+func NewDnstapLogger(path string, timeout time.Duration) (*DnstapLogger, error) {
+	addr, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	output, err := dnstap.NewFrameStreamSockOutput(addr)
+	if err != nil {
+		return nil, err
+	}
+	output.SetTimeout(timeout)
+	go output.RunOutputLoop()
+	hostname, _ := os.Hostname()
+	return &DnstapLogger{Identity: []byte(hostname), Output: output}, nil
+}
+
+func (l *DnstapLogger) Log(e *Entry) {
+	end := e.Time.Add(time.Duration(e.Duration * float64(time.Millisecond)))
+	msgType := dnstap.Message_CLIENT_RESPONSE
+	msg := &dnstap.Message{
+		Type:             &msgType,
+		QueryTimeSec:     proto.Uint64(uint64(e.Time.Unix())),
+		QueryTimeNsec:    proto.Uint32(uint32(e.Time.Nanosecond())),
+		ResponseTimeSec:  proto.Uint64(uint64(end.Unix())),
+		ResponseTimeNsec: proto.Uint32(uint32(end.Nanosecond())),
+	}
+
+	protocol := dnstap.SocketProtocol_TCP // WebSockets run over TCP
+	if e.Transport == "udp" {
+		protocol = dnstap.SocketProtocol_UDP
+	}
+	msg.SocketProtocol = &protocol
+
+	addrPort, err := netip.ParseAddrPort(e.Client)
+	if err != nil {
+		if addr, err := netip.ParseAddr(e.Client); err == nil {
+			addrPort = netip.AddrPortFrom(addr, 0)
+		}
+	}
+	if addr := addrPort.Addr().Unmap(); addr.IsValid() {
+		family := dnstap.SocketFamily_INET
+		if addr.Is6() {
+			family = dnstap.SocketFamily_INET6
+		}
+		msg.SocketFamily = &family
+		msg.QueryAddress = addr.AsSlice()
+		msg.QueryPort = proto.Uint32(uint32(addrPort.Port()))
+	}
+
+	if e.Query != nil {
+		msg.QueryMessage, _ = e.Query.Pack()
+	}
+	if e.Response != nil {
+		msg.ResponseMessage, _ = e.Response.Pack()
+	}
+
+	dtType := dnstap.Dnstap_MESSAGE
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Identity: l.Identity,
+		Version:  []byte("dow-proxy"),
+		Type:     &dtType,
+		Message:  msg,
+	})
+	if err != nil {
+		queryLogLog.Error("Marshal error", "error", err)
+		return
+	}
+
+	select {
+	case l.Output.GetOutputChannel() <- frame:
+	default:
+		queryLogLog.Warn("dnstap output busy, dropping frame")
+	}
+}
+
+func (l *DnstapLogger) Close() {
+	l.Output.Close()
+}
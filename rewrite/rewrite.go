@@ -0,0 +1,292 @@
+// Package rewrite changes queries before they are forwarded and responses
+// before they are returned, following rules read from a file.
+//
+// Each line of the file holds one rule, "#" starts a comment:
+//
+//	name FROM TO         rename FROM and its subdomains to TO before forwarding, and back in the answer
+//	cname FROM TO        answer queries for FROM with a CNAME to TO, followed by the answer for TO
+//	aaaa strip|keep [SUFFIX]  remove AAAA records for SUFFIX and its subdomains (default "."), the longest suffix wins
+//	ttl min|max SECONDS  clamp the TTL of all returned records
+//	edns drop OPTION...  remove EDNS options given by name or code from queries and responses
+package rewrite
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/miekg/dns"
+)
+
+var rewriteLog = logging.New("Rewrite")
+
+type nameRule struct {
+	From, To string
+}
+
+type aaaaRule struct {
+	Suffix string
+	Strip  bool
+}
+
+type Rules struct {
+	Names       []nameRule
+	CNAMEs      map[string]string
+	AAAA        []aaaaRule
+	TTLMin      uint32
+	TTLMax      uint32
+	DropOptions map[uint16]bool
+}
+
+var optionCodes = map[string]uint16{
+	"nsid":      dns.EDNS0NSID,
+	"subnet":    dns.EDNS0SUBNET,
+	"expire":    dns.EDNS0EXPIRE,
+	"cookie":    dns.EDNS0COOKIE,
+	"keepalive": dns.EDNS0TCPKEEPALIVE,
+	"padding":   dns.EDNS0PADDING,
+	"ede":       dns.EDNS0EDE,
+}
+
+// Load reads the rules from a file
+func Load(path string) (*Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &Rules{
+		CNAMEs:      make(map[string]string),
+		DropOptions: make(map[uint16]bool),
+	}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := r.parse(fields); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Rules) parse(fields []string) error {
+	switch fields[0] {
+	case "name", "cname":
+		if len(fields) != 3 {
+			return fmt.Errorf("%s needs FROM and TO names", fields[0])
+		}
+		from, to := dns.CanonicalName(fields[1]), dns.CanonicalName(fields[2])
+		for _, name := range []string{from, to} {
+			if _, ok := dns.IsDomainName(name); !ok {
+				return fmt.Errorf("invalid name %q", name)
+			}
+		}
+		if fields[0] == "name" {
+			r.Names = append(r.Names, nameRule{From: from, To: to})
+		} else {
+			r.CNAMEs[from] = to
+		}
+
+	case "aaaa":
+		if len(fields) < 2 || len(fields) > 3 || (fields[1] != "strip" && fields[1] != "keep") {
+			return fmt.Errorf("aaaa needs strip or keep, and an optional suffix")
+		}
+		suffix := "."
+		if len(fields) == 3 {
+			suffix = dns.CanonicalName(fields[2])
+			if _, ok := dns.IsDomainName(suffix); !ok {
+				return fmt.Errorf("invalid name %q", suffix)
+			}
+		}
+		r.AAAA = append(r.AAAA, aaaaRule{Suffix: suffix, Strip: fields[1] == "strip"})
+
+	case "ttl":
+		if len(fields) != 3 || (fields[1] != "min" && fields[1] != "max") {
+			return fmt.Errorf("ttl needs min or max, and seconds")
+		}
+		ttl, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid ttl %q", fields[2])
+		}
+		if fields[1] == "min" {
+			r.TTLMin = uint32(ttl)
+		} else {
+			r.TTLMax = uint32(ttl)
+		}
+
+	case "edns":
+		if len(fields) < 3 || fields[1] != "drop" {
+			return fmt.Errorf("edns needs drop and at least one option")
+		}
+		for _, s := range fields[2:] {
+			code, found := optionCodes[strings.ToLower(s)]
+			if !found {
+				n, err := strconv.ParseUint(s, 10, 16)
+				if err != nil {
+					return fmt.Errorf("unknown EDNS option %q", s)
+				}
+				code = uint16(n)
+			}
+			r.DropOptions[code] = true
+		}
+
+	default:
+		return fmt.Errorf("unknown rule %q", fields[0])
+	}
+	return nil
+}
+
+// Stage is a chain.Stage applying the rules
+func (r *Rules) Stage(next chain.Handler) chain.Handler {
+	return chain.HandlerFunc(func(ctx context.Context, cr *chain.Request) (*dns.Msg, error) {
+		orig := cr.Msg
+		if orig.IsTsig() != nil || forwarder.IsTransfer(orig) {
+			// signed queries and zone transfers are relayed as they are
+			return next.ServeDNS(ctx, cr)
+		}
+		q := orig.Question[0]
+		name := dns.CanonicalName(q.Name)
+
+		req := orig.Copy()
+		r.dropOptions(req)
+
+		var cname *dns.CNAME
+		if target, found := r.CNAMEs[name]; found {
+			rewriteLog.Debug("Answering with CNAME", "id", orig.Id, "name", name, "target", target)
+			cname = &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: q.Qclass, Ttl: 60},
+				Target: target,
+			}
+			if q.Qtype == dns.TypeCNAME {
+				resp := new(dns.Msg).SetReply(orig)
+				resp.Answer = []dns.RR{cname}
+				return r.finish(orig, resp), nil
+			}
+			req.Question[0].Name = target
+		}
+
+		var rename *nameRule
+		for i := range r.Names {
+			if dns.IsSubDomain(r.Names[i].From, dns.CanonicalName(req.Question[0].Name)) {
+				rename = &r.Names[i]
+				req.Question[0].Name = replaceSuffix(req.Question[0].Name, rename.From, rename.To)
+				rewriteLog.Debug("Renaming query", "id", orig.Id, "name", name, "new_name", req.Question[0].Name)
+				break
+			}
+		}
+
+		resp, err := next.ServeDNS(ctx, cr.WithMsg(req))
+		if resp == nil {
+			return nil, err
+		}
+
+		if rename != nil {
+			for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+				for _, rr := range section {
+					renameRR(rr, rename.To, rename.From)
+				}
+			}
+		}
+		if cname != nil {
+			resp.Answer = append([]dns.RR{cname}, resp.Answer...)
+		}
+		resp.Question = orig.Question
+		resp.Id = orig.Id
+		return r.finish(orig, resp), err
+	})
+}
+
+// finish applies the rules for AAAA records, TTLs and EDNS options
+func (r *Rules) finish(req, resp *dns.Msg) *dns.Msg {
+	if r.stripAAAA(dns.CanonicalName(req.Question[0].Name)) {
+		resp.Answer = withoutAAAA(resp.Answer)
+		resp.Extra = withoutAAAA(resp.Extra)
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if ttl := rr.Header().Ttl; ttl < r.TTLMin {
+				rr.Header().Ttl = r.TTLMin
+			} else if r.TTLMax != 0 && ttl > r.TTLMax {
+				rr.Header().Ttl = r.TTLMax
+			}
+		}
+	}
+	r.dropOptions(resp)
+	return resp
+}
+
+func (r *Rules) stripAAAA(name string) bool {
+	var match *aaaaRule
+	for i, rule := range r.AAAA {
+		if dns.IsSubDomain(rule.Suffix, name) && (match == nil || dns.CountLabel(rule.Suffix) > dns.CountLabel(match.Suffix)) {
+			match = &r.AAAA[i]
+		}
+	}
+	return match != nil && match.Strip
+}
+
+func (r *Rules) dropOptions(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil || len(r.DropOptions) == 0 {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if !r.DropOptions[o.Option()] {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+func withoutAAAA(rrs []dns.RR) []dns.RR {
+	kept := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeAAAA {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// replaceSuffix replaces the from suffix of name with to, keeping the case
+// of the remaining labels
+func replaceSuffix(name, from, to string) string {
+	prefix := name[:len(name)-len(from)]
+	if from == "." {
+		prefix = name
+	}
+	if prefix == "" {
+		return to
+	}
+	if to == "." {
+		return prefix
+	}
+	return prefix + to
+}
+
+func renameRR(rr dns.RR, from, to string) {
+	if dns.IsSubDomain(from, dns.CanonicalName(rr.Header().Name)) {
+		rr.Header().Name = replaceSuffix(rr.Header().Name, from, to)
+	}
+	if cname, ok := rr.(*dns.CNAME); ok && dns.IsSubDomain(from, dns.CanonicalName(cname.Target)) {
+		cname.Target = replaceSuffix(cname.Target, from, to)
+	}
+}
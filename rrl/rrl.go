@@ -0,0 +1,233 @@
+// Package rrl limits the rate of identical UDP responses sent to a client
+// network, in the manner of BIND's Response Rate Limiting, so that the
+// proxy cannot be abused to reflect and amplify traffic towards spoofed
+// source addresses.
+package rrl
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/miekg/dns"
+)
+
+var rrlLog = logging.New("RRL")
+
+type Config struct {
+	// Identical responses per second allowed for each client network
+	ResponsesPerSecond int
+	// Every Slip-th limited response is sent truncated instead of dropped,
+	// so legitimate clients can retry over TCP. 0 drops all of them.
+	Slip int
+	// Time over which responses are accounted. A client network exceeding
+	// the limit for longer is limited until it stays below the limit for
+	// up to Window.
+	Window time.Duration
+	// Only log which responses would be limited
+	LogOnly bool
+	// Prefix lengths grouping client addresses into networks
+	IPv4Prefix, IPv6Prefix int
+	// Maximum number of tracked client networks and responses
+	MaxEntries int
+	// EDNS UDP buffer size advertised in truncated responses
+	UDPBufferSize uint16
+}
+
+type entry struct {
+	// responses that may still be sent, limited while negative
+	Balance float64
+	Last    time.Time
+	Limited bool
+	Limits  int
+}
+
+// Limiter is a chain stage applying the limit to UDP responses
+type Limiter struct {
+	Config    Config
+	Mutex     sync.Mutex
+	Entries   map[string]*entry
+	LastSweep time.Time
+}
+
+func New(cfg Config) *Limiter {
+	if cfg.Window <= 0 {
+		cfg.Window = 15 * time.Second
+	}
+	if cfg.IPv4Prefix == 0 {
+		cfg.IPv4Prefix = 24
+	}
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = 56
+	}
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = 100000
+	}
+	if cfg.UDPBufferSize == 0 {
+		cfg.UDPBufferSize = 1232
+	}
+	return &Limiter{
+		Config:    cfg,
+		Entries:   make(map[string]*entry),
+		LastSweep: time.Now(),
+	}
+}
+
+const (
+	allow = iota
+	slip
+	drop
+)
+
+// Stage is a chain.Stage limiting the responses of the rest of the chain
+func (l *Limiter) Stage(next chain.Handler) chain.Handler {
+	return chain.HandlerFunc(func(ctx context.Context, r *chain.Request) (*dns.Msg, error) {
+		resp, err := next.ServeDNS(ctx, r)
+		if resp == nil || r.Transport != "udp" {
+			return resp, err
+		}
+		network, ok := l.network(r.Client)
+		if !ok {
+			return resp, err
+		}
+
+		category, name := classify(resp)
+		key := fmt.Sprintf("%s %s %s", network, category, name)
+		switch l.account(key) {
+		case slip:
+			tc := new(dns.Msg).SetReply(r.Msg)
+			tc.Truncated = true
+			if opt := r.Msg.IsEdns0(); opt != nil {
+				tc.SetEdns0(l.Config.UDPBufferSize, opt.Do())
+			}
+			return tc, nil
+		case drop:
+			return nil, forwarder.ErrDropped
+		}
+		return resp, err
+	})
+}
+
+// network returns the client network of a client address
+func (l *Limiter) network(client string) (netip.Prefix, bool) {
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(client)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		addr = addrPort.Addr()
+	}
+	addr = addr.Unmap()
+	bits := l.Config.IPv4Prefix
+	if addr.Is6() {
+		bits = l.Config.IPv6Prefix
+	}
+	prefix, err := addr.Prefix(bits)
+	return prefix, err == nil
+}
+
+// classify groups responses like BIND does: positive answers by name and
+// type, NXDOMAIN by zone so random names cannot avoid the limit, and errors
+// all together
+func classify(resp *dns.Msg) (string, string) {
+	q := resp.Question[0]
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		if len(resp.Answer) == 0 {
+			return "nodata", dns.CanonicalName(q.Name)
+		}
+		return "response", dns.CanonicalName(q.Name) + " " + dns.TypeToString[q.Qtype]
+	case dns.RcodeNameError:
+		for _, rr := range resp.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return "nxdomain", dns.CanonicalName(rr.Header().Name)
+			}
+		}
+		return "nxdomain", "."
+	}
+	return "error", ""
+}
+
+// account charges a response to key and decides what happens to it
+func (l *Limiter) account(key string) int {
+	now := time.Now()
+	rate := float64(l.Config.ResponsesPerSecond)
+
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+
+	if now.Sub(l.LastSweep) >= l.Config.Window {
+		l.sweep(now)
+	}
+
+	e := l.Entries[key]
+	if e == nil {
+		if len(l.Entries) >= l.Config.MaxEntries {
+			l.sweep(now)
+			// still full, make room at random
+			for k := range l.Entries {
+				if len(l.Entries) < l.Config.MaxEntries {
+					break
+				}
+				delete(l.Entries, k)
+			}
+		}
+		e = &entry{Balance: rate, Last: now}
+		l.Entries[key] = e
+	}
+
+	e.Balance += now.Sub(e.Last).Seconds() * rate
+	if e.Balance > rate {
+		e.Balance = rate
+	}
+	e.Last = now
+	e.Balance--
+	if floor := -rate * l.Config.Window.Seconds(); e.Balance < floor {
+		e.Balance = floor
+	}
+
+	if e.Balance >= 0 {
+		return allow
+	}
+
+	if !e.Limited {
+		e.Limited = true
+		if l.Config.LogOnly {
+			rrlLog.Info("Would limit responses", "key", key)
+		} else {
+			rrlLog.Info("Limiting responses", "key", key)
+		}
+	}
+	e.Limits++
+	if l.Config.LogOnly {
+		return allow
+	}
+	if l.Config.Slip != 0 && e.Limits%l.Config.Slip == 0 {
+		return slip
+	}
+	return drop
+}
+
+// sweep forgets entries that are back at their full balance, ending the
+// limiting of their responses
+func (l *Limiter) sweep(now time.Time) {
+	rate := float64(l.Config.ResponsesPerSecond)
+	for k, e := range l.Entries {
+		if e.Balance+now.Sub(e.Last).Seconds()*rate < rate {
+			continue
+		}
+		if e.Limited && l.Config.LogOnly {
+			rrlLog.Info("Would have stopped limiting responses", "key", k, "limited", e.Limits)
+		} else if e.Limited {
+			rrlLog.Info("Stopped limiting responses", "key", k, "limited", e.Limits)
+		}
+		delete(l.Entries, k)
+	}
+	l.LastSweep = now
+}
@@ -0,0 +1,171 @@
+package rrl
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/miekg/dns"
+)
+
+// answer responds with one A record
+var answer = chain.HandlerFunc(func(ctx context.Context, r *chain.Request) (*dns.Msg, error) {
+	resp := new(dns.Msg).SetReply(r.Msg)
+	rr, _ := dns.NewRR(r.Msg.Question[0].Name + " 60 IN A 192.0.2.1")
+	resp.Answer = append(resp.Answer, rr)
+	return resp, nil
+})
+
+// outcome sends a query through the stage and tells what became of the
+// response: "allow", "slip" or "drop"
+func outcome(t *testing.T, h chain.Handler, client, transport string) string {
+	t.Helper()
+	req := new(dns.Msg).SetQuestion("www.example.org.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	resp, err := h.ServeDNS(context.Background(), &chain.Request{Msg: req, Client: client, Transport: transport})
+	switch {
+	case errors.Is(err, forwarder.ErrDropped) && resp == nil:
+		return "drop"
+	case err != nil:
+		t.Fatal(err)
+	case resp.Truncated:
+		if len(resp.Answer) != 0 || resp.Id != req.Id {
+			t.Errorf("slipped response is not an empty truncated reply: %v", resp)
+		}
+		if opt := resp.IsEdns0(); opt == nil || opt.UDPSize() != 1232 || !opt.Do() {
+			t.Errorf("slipped response has OPT %v, want size 1232 with DO", opt)
+		}
+		return "slip"
+	}
+	return "allow"
+}
+
+func TestSlip(t *testing.T) {
+	tests := []struct {
+		name    string
+		slip    int
+		logOnly bool
+		// outcomes after the 3 allowed responses
+		want []string
+	}{
+		{"slip every second", 2, false, []string{"drop", "slip", "drop", "slip", "drop", "slip"}},
+		{"slip every third", 3, false, []string{"drop", "drop", "slip", "drop", "drop", "slip"}},
+		{"slip all", 1, false, []string{"slip", "slip", "slip", "slip"}},
+		{"drop all", 0, false, []string{"drop", "drop", "drop", "drop"}},
+		{"log only", 2, true, []string{"allow", "allow", "allow", "allow"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(Config{ResponsesPerSecond: 3, Slip: tt.slip, LogOnly: tt.logOnly, Window: time.Minute})
+			h := l.Stage(answer)
+			want := append([]string{"allow", "allow", "allow"}, tt.want...)
+			for i, w := range want {
+				if got := outcome(t, h, "192.0.2.10:5353", "udp"); got != w {
+					t.Errorf("response %d: %s, want %s", i+1, got, w)
+				}
+			}
+		})
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	l := New(Config{ResponsesPerSecond: 1, Slip: 0, Window: time.Minute})
+	h := l.Stage(answer)
+
+	if got := outcome(t, h, "192.0.2.10:5353", "udp"); got != "allow" {
+		t.Fatalf("first response: %s, want allow", got)
+	}
+	// same /24
+	if got := outcome(t, h, "192.0.2.200:5353", "udp"); got != "drop" {
+		t.Errorf("same network: %s, want drop", got)
+	}
+	if got := outcome(t, h, "[::ffff:192.0.2.20]:5353", "udp"); got != "drop" {
+		t.Errorf("IPv4-mapped address of the same network: %s, want drop", got)
+	}
+	if got := outcome(t, h, "198.51.100.1:5353", "udp"); got != "allow" {
+		t.Errorf("other network: %s, want allow", got)
+	}
+	// same /56
+	if got := outcome(t, h, "[2001:db8:0:1::1]:5353", "udp"); got != "allow" {
+		t.Errorf("first IPv6 response: %s, want allow", got)
+	}
+	if got := outcome(t, h, "[2001:db8:0:ff::2]:5353", "udp"); got != "drop" {
+		t.Errorf("same IPv6 network: %s, want drop", got)
+	}
+	if got := outcome(t, h, "[2001:db8:0:100::1]:5353", "udp"); got != "allow" {
+		t.Errorf("other IPv6 network: %s, want allow", got)
+	}
+	// TCP clients cannot spoof their address
+	for i := 0; i < 3; i++ {
+		if got := outcome(t, h, "192.0.2.10:5353", "tcp"); got != "allow" {
+			t.Errorf("TCP response %d: %s, want allow", i+1, got)
+		}
+	}
+}
+
+func TestRefill(t *testing.T) {
+	l := New(Config{ResponsesPerSecond: 2, Slip: 0, Window: time.Minute})
+	h := l.Stage(answer)
+	for i, want := range []string{"allow", "allow", "drop", "drop"} {
+		if got := outcome(t, h, "192.0.2.10:5353", "udp"); got != want {
+			t.Errorf("response %d: %s, want %s", i+1, got, want)
+		}
+	}
+
+	// a second later two responses have been earned back, minus the two
+	// limited ones
+	l.Mutex.Lock()
+	for _, e := range l.Entries {
+		e.Last = e.Last.Add(-time.Second)
+	}
+	l.Mutex.Unlock()
+	for i, want := range []string{"drop", "drop"} {
+		if got := outcome(t, h, "192.0.2.10:5353", "udp"); got != want {
+			t.Errorf("response %d after a second: %s, want %s", i+1, got, want)
+		}
+	}
+
+	l.Mutex.Lock()
+	for _, e := range l.Entries {
+		e.Last = e.Last.Add(-2 * time.Second)
+	}
+	l.Mutex.Unlock()
+	for i, want := range []string{"allow", "allow", "drop"} {
+		if got := outcome(t, h, "192.0.2.10:5353", "udp"); got != want {
+			t.Errorf("response %d after three seconds: %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	soa, _ := dns.NewRR("example.org. 3600 IN SOA ns.example.org. admin.example.org. 1 7200 3600 1209600 300")
+	a, _ := dns.NewRR("www.example.org. 60 IN A 192.0.2.1")
+	tests := []struct {
+		name     string
+		qname    string
+		rcode    int
+		answer   []dns.RR
+		ns       []dns.RR
+		category string
+		key      string
+	}{
+		{"answer", "WWW.example.org.", dns.RcodeSuccess, []dns.RR{a}, nil, "response", "www.example.org. A"},
+		{"nodata", "www.example.org.", dns.RcodeSuccess, nil, []dns.RR{soa}, "nodata", "www.example.org."},
+		{"nxdomain by zone", "random.example.org.", dns.RcodeNameError, nil, []dns.RR{soa}, "nxdomain", "example.org."},
+		{"nxdomain without SOA", "random.example.org.", dns.RcodeNameError, nil, nil, "nxdomain", "."},
+		{"error", "www.example.org.", dns.RcodeServerFailure, nil, nil, "error", ""},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg).SetQuestion(tt.qname, dns.TypeA)
+		resp := new(dns.Msg).SetRcode(req, tt.rcode)
+		resp.Answer = tt.answer
+		resp.Ns = tt.ns
+		category, key := classify(resp)
+		if category != tt.category || key != tt.key {
+			t.Errorf("%s: classify = %q %q, want %q %q", tt.name, category, key, tt.category, tt.key)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Package servertls provides the certificates and protocol settings of the
+// TLS listener in server mode.
+package servertls
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig holds the settings of certificates obtained with ACME
+type ACMEConfig struct {
+	// Domains certificates are obtained for, other server names are refused
+	Domains []string
+	// ACME directory URL, Let's Encrypt if empty
+	DirectoryURL string
+	// Directory keeping the account key and certificates across restarts,
+	// memory only if empty
+	CacheDir string
+	// Optional contact email of the account
+	Email string
+	// CA certificates trusted for the directory, such as those of a test
+	// server like Pebble, the system roots if nil
+	RootCAs *x509.CertPool
+}
+
+// ACME obtains certificates when they are first needed, and renews them
+// before they expire. TLS-ALPN-01 challenges are answered by the TLS
+// listener, HTTP-01 challenges by HTTPHandler served on port 80.
+type ACME struct {
+	Manager *autocert.Manager
+}
+
+func NewACME(cfg ACMEConfig) *ACME {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.RootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: cfg.RootCAs}
+	}
+	client := &acme.Client{
+		DirectoryURL: cfg.DirectoryURL,
+		HTTPClient: &http.Client{
+			Transport: &orderLocations{RoundTripper: transport, Orders: make(map[string]string)},
+		},
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Client:     client,
+		Email:      cfg.Email,
+	}
+	if cfg.CacheDir != "" {
+		m.Cache = autocert.DirCache(cfg.CacheDir)
+	}
+	return &ACME{Manager: m}
+}
+
+// TLSConfig returns the TLS settings of a listener with the certificates,
+// which also answers TLS-ALPN-01 challenges
+func (a *ACME) TLSConfig() *tls.Config {
+	return a.Manager.TLSConfig()
+}
+
+// HTTPHandler answers HTTP-01 challenges, and redirects other requests to
+// HTTPS
+func (a *ACME) HTTPHandler() http.Handler {
+	return a.Manager.HTTPHandler(nil)
+}
+
+// orderLocations adds the order URL to responses finalizing an order, which
+// the ACME client needs to wait for the certificate but servers such as
+// Pebble leave out, as RFC 8555 allows
+type orderLocations struct {
+	http.RoundTripper
+	Mutex sync.Mutex
+	// order URLs mapped by finalize URL
+	Orders map[string]string
+}
+
+func (o *orderLocations) RoundTrip(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	resp, err := o.RoundTripper.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost {
+		return resp, err
+	}
+
+	o.Mutex.Lock()
+	orderURL, finalizing := o.Orders[url]
+	if finalizing {
+		delete(o.Orders, url)
+	}
+	o.Mutex.Unlock()
+	if finalizing {
+		if resp.Header.Get("Location") == "" {
+			resp.Header.Set("Location", orderURL)
+		}
+		return resp, nil
+	}
+
+	// new orders are created with a location and a finalize URL
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusCreated || location == "" {
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var order struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &order) == nil && order.Finalize != "" {
+		o.Mutex.Lock()
+		o.Orders[order.Finalize] = location
+		o.Mutex.Unlock()
+	}
+	return resp, nil
+}
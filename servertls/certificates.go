@@ -0,0 +1,99 @@
+package servertls
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/logging"
+)
+
+var tlsLog = logging.New("TLS")
+
+// Time between checks for changed certificate files
+const checkInterval = time.Second
+
+// KeyPair is a certificate and private key loaded from files
+type KeyPair struct {
+	CertFile    string
+	KeyFile     string
+	Certificate *tls.Certificate
+	CertModTime time.Time
+	KeyModTime  time.Time
+}
+
+// Load (re)reads the certificate and key. The files are skipped if neither
+// has changed since the last load.
+func (p *KeyPair) Load() error {
+	certInfo, err := os.Stat(p.CertFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(p.KeyFile)
+	if err != nil {
+		return err
+	}
+	if certInfo.ModTime().Equal(p.CertModTime) && keyInfo.ModTime().Equal(p.KeyModTime) {
+		return nil
+	}
+	// a certificate and key written one after the other are only tried
+	// again once either changes
+	p.CertModTime = certInfo.ModTime()
+	p.KeyModTime = keyInfo.ModTime()
+
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return err
+	}
+	p.Certificate = &cert
+	tlsLog.Info("Loaded certificate", "path", p.CertFile, "names", cert.Leaf.DNSNames, "expires", cert.Leaf.NotAfter)
+	return nil
+}
+
+// Certificates selects among key pairs by the server name and supported
+// algorithms of a TLS handshake, and picks up changed files without a
+// restart
+type Certificates struct {
+	KeyPairs []*KeyPair
+	Mutex    sync.Mutex
+	Checked  time.Time
+}
+
+// LoadCertificates loads pairs of certificate and key files
+func LoadCertificates(certFiles, keyFiles []string) (*Certificates, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, errors.New("every certificate needs a key")
+	}
+	c := &Certificates{Checked: time.Now()}
+	for i := range certFiles {
+		p := &KeyPair{CertFile: certFiles[i], KeyFile: keyFiles[i]}
+		if err := p.Load(); err != nil {
+			return nil, err
+		}
+		c.KeyPairs = append(c.KeyPairs, p)
+	}
+	return c, nil
+}
+
+// GetCertificate returns the first certificate supported by the client,
+// or the first certificate if none is
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if time.Since(c.Checked) >= checkInterval {
+		c.Checked = time.Now()
+		for _, p := range c.KeyPairs {
+			if err := p.Load(); err != nil {
+				tlsLog.Warn("Reload error, keeping the loaded certificate", "path", p.CertFile, "error", err)
+			}
+		}
+	}
+	for _, p := range c.KeyPairs {
+		if hello.SupportsCertificate(p.Certificate) == nil {
+			return p.Certificate, nil
+		}
+	}
+	return c.KeyPairs[0].Certificate, nil
+}
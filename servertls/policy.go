@@ -0,0 +1,95 @@
+package servertls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Policy holds the protocol settings of the TLS listener
+type Policy struct {
+	MinVersion uint16
+	// Highest version, TLS 1.3 if 0
+	MaxVersion uint16
+	// Cipher suites of TLS 1.2 and earlier, the Go defaults if nil. Those
+	// of TLS 1.3 are not configurable.
+	CipherSuites []uint16
+	// Key exchange mechanisms in order of preference, the Go defaults if
+	// nil
+	CurvePreferences []tls.CurveID
+}
+
+// Apply sets the policy in c
+func (p Policy) Apply(c *tls.Config) {
+	c.MinVersion = p.MinVersion
+	c.MaxVersion = p.MaxVersion
+	c.CipherSuites = p.CipherSuites
+	c.CurvePreferences = p.CurvePreferences
+}
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion parses a TLS version given as 1.0, 1.1, 1.2, or 1.3
+func ParseVersion(s string) (uint16, error) {
+	if v, ok := versions[s]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown version %q", s)
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names such
+// as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Only those considered secure
+// by Go are accepted.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		i := slices.IndexFunc(tls.CipherSuites(), func(c *tls.CipherSuite) bool {
+			return c.Name == name
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suite := tls.CipherSuites()[i]
+		if !slices.ContainsFunc(suite.SupportedVersions, func(v uint16) bool { return v < tls.VersionTLS13 }) {
+			return nil, fmt.Errorf("cipher suite %q of TLS 1.3 is not configurable", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// ParseCurves parses a comma separated list of key exchange mechanisms:
+// X25519, P256, P384, P521, or X25519MLKEM768
+func ParseCurves(s string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := curves[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
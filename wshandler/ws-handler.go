@@ -0,0 +1,453 @@
+// Package wshandler serves DNS over WebSocket clients. The Handler is an
+// http.Handler and can be mounted on any mux.
+package wshandler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dnschecktool/dow-proxy/chain"
+	"github.com/dnschecktool/dow-proxy/dnsjson"
+	"github.com/dnschecktool/dow-proxy/forwarder"
+	"github.com/dnschecktool/dow-proxy/framing"
+	"github.com/dnschecktool/dow-proxy/internal/extconnect"
+	"github.com/dnschecktool/dow-proxy/logging"
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+)
+
+var wsHandlerLog = logging.New("WebSocketHandler")
+
+// Config holds the handler settings. Zero values are replaced with the
+// defaults of the dow-proxy command.
+type Config struct {
+	// Query processing chain, usually ending with chain.Forward
+	Handler chain.Handler
+	// Maximum time to wait for network activities
+	Timeout time.Duration
+	// EDNS UDP buffer size advertised in generated responses
+	UDPBufferSize uint16
+	// WebSocket read and write buffer size
+	WSBufferSize int
+	// Maximum number of WebSockets to serve simultaneously
+	MaxWebSockets int
+	// Maximum number of open requests per WebSocket
+	RequestsPerWebSocket int
+	// Maximum size of a received WebSocket message
+	ReadLimit int64
+	// Use the X-Real-IP header set by a reverse proxy as client address
+	TrustRealIP bool
+	// WebSocket subprotocols accepted in order of preference,
+	// framing.Supported if nil. Clients offering none of them get
+	// framing.V1.
+	Subprotocols []string
+	// Maximum size of a WebSocket message carrying a batch of responses
+	BatchSize int
+	// Maximum time a response waits for others to be batched with
+	BatchDelay time.Duration
+	// Accept permessage-deflate compression offered by clients, without
+	// context takeover
+	Compression bool
+	// Compression level from 1 (fastest) to 9 (smallest)
+	CompressionLevel int
+	// WebSocket messages smaller than this many bytes are sent uncompressed
+	CompressionMinSize int
+	// Accept queries in the JSON format of the Google and Cloudflare DNS
+	// over HTTPS JSON APIs as text messages, answered with JSON text
+	// messages
+	JSON bool
+	// Keys verifying signed queries, mapped by canonical name. The responses
+	// are signed with the same key. Queries signed with other keys are
+	// passed on unchanged.
+	TSIGKeys map[string]*forwarder.TSIGKey
+	// Answer queries not signed with one of TSIGKeys with NOTAUTH
+	RequireTSIG bool
+}
+
+// response is a DNS message in wire format, or a JSON response in a text
+// message
+type response struct {
+	data []byte
+	text bool
+}
+
+type Handler struct {
+	Config    Config
+	Upgrader  *websocket.Upgrader
+	Semaphore chan bool
+}
+
+func New(cfg Config) *Handler {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.UDPBufferSize == 0 {
+		cfg.UDPBufferSize = 1232
+	}
+	if cfg.WSBufferSize == 0 {
+		cfg.WSBufferSize = 512
+	}
+	if cfg.MaxWebSockets == 0 {
+		cfg.MaxWebSockets = 50
+	}
+	if cfg.RequestsPerWebSocket == 0 {
+		cfg.RequestsPerWebSocket = 50
+	}
+	if cfg.ReadLimit == 0 {
+		cfg.ReadLimit = 4096
+	}
+	if cfg.Subprotocols == nil {
+		cfg.Subprotocols = framing.Supported
+	}
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 4096
+	}
+	if cfg.BatchDelay == 0 {
+		cfg.BatchDelay = time.Millisecond
+	}
+	if cfg.CompressionLevel == 0 {
+		cfg.CompressionLevel = 1
+	}
+	if cfg.CompressionMinSize == 0 {
+		cfg.CompressionMinSize = 256
+	}
+	return &Handler{
+		Config: cfg,
+		Upgrader: &websocket.Upgrader{
+			HandshakeTimeout:  cfg.Timeout,
+			ReadBufferSize:    cfg.WSBufferSize,
+			WriteBufferSize:   cfg.WSBufferSize,
+			Subprotocols:      cfg.Subprotocols,
+			EnableCompression: cfg.Compression,
+			CheckOrigin:       func(_ *http.Request) bool { return true },
+		},
+		Semaphore: make(chan bool, cfg.MaxWebSockets),
+	}
+}
+
+func (h *Handler) OpenWebSockets() int {
+	return len(h.Semaphore)
+}
+
+func (h *Handler) ServeHTTP(hrw http.ResponseWriter, hr *http.Request) {
+	var remote string
+	if h.Config.TrustRealIP {
+		remote = hr.Header.Get("X-Real-IP")
+	}
+	if remote == "" {
+		remote = hr.RemoteAddr
+	}
+	log := wsHandlerLog.With("remote", remote)
+
+	// WebSockets are opened with HTTP/1.1 upgrades, or with extended CONNECT
+	// over HTTP/2
+	extended := extconnect.IsRequest(hr)
+	if !extended && !websocket.IsWebSocketUpgrade(hr) {
+		http.Error(hrw, "Bad Request: Not a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case h.Semaphore <- true:
+		defer func() { <-h.Semaphore }()
+
+	default:
+		log.Debug("Denied, maximum WebSockets reached")
+		http.Error(hrw, "Service Unavailable: Too busy, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	var conn *websocket.Conn
+	var err error
+	if extended {
+		conn, err = extconnect.Upgrade(h.Upgrader, hrw, hr)
+	} else {
+		conn, err = h.Upgrader.Upgrade(hrw, hr, nil)
+	}
+	if err != nil {
+		log.Debug("Upgrade error", "error", err)
+		return
+	}
+	conn.SetReadLimit(h.Config.ReadLimit)
+	if err := conn.SetCompressionLevel(h.Config.CompressionLevel); err != nil {
+		log.Error("Compression level error", "error", err)
+		conn.Close()
+		return
+	}
+	f := framing.Lookup(conn.Subprotocol())
+
+	log.Debug("Accepted connection", "proto", hr.Proto, "subprotocol", conn.Subprotocol())
+
+	// cancelled when the client goes away, abandoning its open requests
+	ctx, cancel := context.WithCancel(hr.Context())
+	defer cancel()
+
+	var routines, queries sync.WaitGroup
+	dnsResponses := make(chan response) // not buffered
+
+	routines.Add(1)
+	go func() {
+		log.Debug("Starting write loop")
+		defer func() {
+			log.Debug("Exiting write loop")
+			routines.Done()
+		}()
+		write := func(msgs [][]byte) {
+			if len(msgs) == 0 {
+				return
+			}
+			messageType, data, err := f.Encode(msgs)
+			if err != nil {
+				log.Error("Encode error", "error", err)
+				return
+			}
+			conn.EnableWriteCompression(len(data) >= h.Config.CompressionMinSize)
+			err = conn.WriteMessage(messageType, data)
+			if err != nil {
+				log.Debug("WriteMessage error", "error", err)
+			}
+		}
+		// batched framings collect responses until the batch is full, or
+		// for BatchDelay
+		batcher := &framing.Batcher{MaxSize: h.Config.BatchSize}
+		timer := time.NewTimer(h.Config.BatchDelay)
+		timer.Stop()
+		for {
+			select {
+			case resp, ok := <-dnsResponses:
+				if !ok {
+					write(batcher.Take())
+					return
+				}
+				if resp.text {
+					err := conn.WriteMessage(websocket.TextMessage, resp.data)
+					if err != nil {
+						log.Debug("WriteMessage error", "error", err)
+					}
+					continue
+				}
+				dnsRespBytes := resp.data
+				if !f.Batched() {
+					write([][]byte{dnsRespBytes})
+					continue
+				}
+				if !batcher.Fits(dnsRespBytes) {
+					write(batcher.Take())
+				}
+				batcher.Add(dnsRespBytes)
+				if batcher.Len() == 1 {
+					timer.Reset(h.Config.BatchDelay)
+				}
+
+			case <-timer.C:
+				write(batcher.Take())
+			}
+		}
+	}()
+
+	respond := func(dnsResp *dns.Msg, session *forwarder.TSIGSession) {
+		var dnsRespBytes []byte
+		var err error
+		if session != nil {
+			dnsRespBytes, err = session.Sign(dnsResp)
+		} else {
+			dnsRespBytes, err = dnsResp.Pack()
+		}
+		if err != nil {
+			log.Error("Pack error", "id", dnsResp.Id, "error", err)
+			return
+		}
+		dnsResponses <- response{data: dnsRespBytes}
+	}
+	// messages of zone transfers and signed responses, as they are
+	stream := func(dnsRespBytes []byte) error {
+		dnsResponses <- response{data: dnsRespBytes}
+		return nil
+	}
+	respondJSON := func(id json.RawMessage, dnsResp *dns.Msg) {
+		data, err := dnsjson.MarshalResponse(id, dnsResp)
+		if err != nil {
+			log.Error("JSON error", "id", dnsResp.Id, "error", err)
+			return
+		}
+		dnsResponses <- response{data: data, text: true}
+	}
+	// messages of zone transfers, each in its own JSON response
+	streamJSON := func(id json.RawMessage) func([]byte) error {
+		return func(dnsRespBytes []byte) error {
+			dnsResp := new(dns.Msg)
+			if err := dnsResp.Unpack(dnsRespBytes); err != nil {
+				return err
+			}
+			respondJSON(id, dnsResp)
+			return nil
+		}
+	}
+
+	requestsSemaphore := make(chan bool, h.Config.RequestsPerWebSocket)
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Debug("ReadMessage error", "error", err)
+			break
+		}
+
+		if messageType == websocket.TextMessage && h.Config.JSON {
+			dnsReq, id, err := dnsjson.ParseQuery(data, h.Config.UDPBufferSize)
+			if err != nil {
+				log.Debug("Invalid JSON query", "error", err)
+				data, err = dnsjson.MarshalError(id, err)
+				if err == nil {
+					dnsResponses <- response{data: data, text: true}
+				}
+				continue
+			}
+			select {
+			case requestsSemaphore <- true:
+				queries.Add(1)
+				go func() {
+					defer func() {
+						<-requestsSemaphore
+						queries.Done()
+					}()
+					// JSON queries cannot be signed
+					if _, err := h.verify(nil, dnsReq); err != nil {
+						respondJSON(id, forwarder.TSIGErrorResponse(dnsReq, err))
+						return
+					}
+					r := &chain.Request{
+						Msg:       dnsReq,
+						Client:    remote,
+						Transport: "ws",
+						Stream:    streamJSON(id),
+					}
+					if dnsResp := chain.Resolve(ctx, h.Config.Handler, r, h.Config.UDPBufferSize); dnsResp != nil {
+						respondJSON(id, dnsResp)
+					}
+				}()
+
+			default:
+				log.Debug("Maximum open requests reached, refusing JSON query")
+				respondJSON(id, forwarder.ErrorResponse(dnsReq, forwarder.ErrBusy, h.Config.UDPBufferSize))
+			}
+			continue
+		}
+
+		msgs, dnsReqs, err := decode(f, messageType, data)
+		if err != nil {
+			log.Debug("Invalid message received, closing", "error", err)
+			data = websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "")
+			err = conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(h.Config.Timeout))
+			if err != nil {
+				log.Debug("WriteControl error", "error", err)
+			}
+			break
+		}
+
+		for i := range dnsReqs {
+			dnsReq, messageBytes := dnsReqs[i], msgs[i]
+			select {
+			case requestsSemaphore <- true:
+				queries.Add(1)
+				go func() {
+					defer func() {
+						<-requestsSemaphore
+						queries.Done()
+					}()
+					session, err := h.verify(messageBytes, dnsReq)
+					if err != nil {
+						log.Debug("TSIG error", "id", dnsReq.Id, "error", err)
+						respond(forwarder.TSIGErrorResponse(dnsReq, err), nil)
+						return
+					}
+					r := &chain.Request{
+						Msg:       dnsReq,
+						Client:    remote,
+						Transport: "ws",
+						Stream:    stream,
+					}
+					// still signed, for the upstream to verify
+					if session == nil && dnsReq.IsTsig() != nil {
+						r.Raw = messageBytes
+					}
+					if session != nil {
+						r.Stream = func(dnsRespBytes []byte) error {
+							dnsResp := new(dns.Msg)
+							if err := dnsResp.Unpack(dnsRespBytes); err != nil {
+								return err
+							}
+							dnsRespBytes, err := session.Sign(dnsResp)
+							if err != nil {
+								return err
+							}
+							return stream(dnsRespBytes)
+						}
+					}
+					if dnsResp := chain.Resolve(ctx, h.Config.Handler, r, h.Config.UDPBufferSize); dnsResp != nil {
+						// RFC 8467: pad responses only to clients that pad their queries
+						if forwarder.IsPadded(dnsReq) {
+							forwarder.Pad(dnsResp, forwarder.ResponsePaddingBlock)
+						}
+						respond(dnsResp, session)
+					}
+				}()
+
+			default:
+				log.Debug("Maximum open requests reached, refusing query", "id", dnsReq.Id)
+				respond(forwarder.ErrorResponse(dnsReq, forwarder.ErrBusy, h.Config.UDPBufferSize), nil)
+			}
+		}
+	}
+
+	conn.Close()
+	cancel()
+	queries.Wait()
+	close(dnsResponses)
+	routines.Wait()
+
+	log.Debug("Finished")
+}
+
+// verify checks the signature of a query signed with one of the keys, and
+// removes it. The session then signs the responses.
+func (h *Handler) verify(dnsReqBytes []byte, dnsReq *dns.Msg) (*forwarder.TSIGSession, error) {
+	var key *forwarder.TSIGKey
+	t := dnsReq.IsTsig()
+	if t != nil {
+		key = h.Config.TSIGKeys[dns.CanonicalName(t.Hdr.Name)]
+	}
+	if key == nil {
+		if !h.Config.RequireTSIG {
+			return nil, nil
+		}
+		if t == nil {
+			return nil, dns.ErrNoSig
+		}
+		return nil, dns.ErrSecret
+	}
+	session := &forwarder.TSIGSession{Key: key}
+	if err := session.Verify(dnsReqBytes, dnsReq); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// decode returns the queries carried by a WebSocket message, and each one in
+// wire format
+func decode(f framing.Framing, messageType int, data []byte) ([][]byte, []*dns.Msg, error) {
+	msgs, err := f.Decode(messageType, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	dnsReqs := make([]*dns.Msg, len(msgs))
+	for i, messageBytes := range msgs {
+		dnsReqs[i] = new(dns.Msg)
+		if err := dnsReqs[i].Unpack(messageBytes); err != nil {
+			return nil, nil, err
+		}
+	}
+	return msgs, dnsReqs, nil
+}